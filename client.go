@@ -0,0 +1,676 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+	"github.com/pyke369/golang-support/uhash"
+	"github.com/pyke369/golang-support/ustr"
+)
+
+const (
+	CLIENT_HOOK_TIMEOUT   = 30 * time.Second
+	CLIENT_REBOOT_TIMEOUT = 10 * time.Second
+)
+
+type ROUTE struct {
+	Destination *net.IPNet
+	Gateway     net.IP
+}
+
+type NETWORK struct {
+	Address *net.IPNet
+	Routes  []ROUTE
+	MTU     int
+}
+
+type SETTINGS struct {
+	Configure       bool
+	Script          string
+	Leases          string
+	Probes          int
+	Wait            time.Duration
+	Policy          []string
+	Retransmissions int
+	Deadline        time.Duration
+}
+
+type CLIENT struct {
+	SETTINGS
+	conn      *Conn
+	port      int
+	template  FRAME
+	store     string
+	network   *NETWORK
+	mtu       int
+	state     string
+	offer     FRAME
+	lease     FRAME
+	address   net.IP
+	server    *Addr
+	renewal   time.Time
+	rebinding time.Time
+	expires   time.Time
+	started   time.Time
+	sent      time.Time
+	signals   chan os.Signal
+}
+
+func NewClient(conn *Conn, port int, template FRAME, settings SETTINGS) *CLIENT {
+	client := &CLIENT{SETTINGS: settings, conn: conn, port: port, template: template, signals: make(chan os.Signal, 4)}
+	if settings.Leases != "" {
+		client.store = filepath.Join(settings.Leases, conn.Local.Device+".lease")
+	}
+	signal.Notify(client.signals, syscall.SIGUSR1, syscall.SIGUSR2)
+
+	return client
+}
+
+// every state change is emitted on stdout as a JSON event (along with the reply which triggered it, if any)
+func (c *CLIENT) transition(state string, frame FRAME, reason string) {
+	event := map[string]any{"time": time.Now().Unix(), "interface": c.conn.Local.Device, "state": state, "previous": c.state}
+	if c.address != nil {
+		event["address"] = c.address.String()
+	}
+	if reason != "" {
+		event["reason"] = reason
+	}
+	if frame != nil {
+		event["frame"] = frame
+	}
+	c.state = state
+	if content, err := json.Marshal(event); err == nil {
+		os.Stdout.Write(append(content, '\n'))
+	}
+}
+
+func because(reasons ...string) string {
+	parts := []string{}
+	for _, reason := range reasons {
+		if reason != "" {
+			parts = append(parts, reason)
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// the hook script is run synchronously with the event name as argument (udhcpc-style), the reply being passed through
+// environment variables (its standard output is redirected to stderr, so as not to interfere with the JSON events); the
+// whole process group is killed if it doesn't complete in time
+func (c *CLIENT) hook(event string, frame FRAME) string {
+	if c.Script == "" {
+		return ""
+	}
+
+	env := []string{}
+	for _, value := range os.Environ() {
+		if !strings.HasPrefix(value, "PDHCP_") {
+			env = append(env, value)
+		}
+	}
+	env = append(env, "interface="+c.conn.Local.Device)
+	if frame != nil {
+		for name, value := range frame {
+			env = append(env, envname(name)+"="+textvalue(value))
+		}
+		if address := net.ParseIP(j.String(frame["bootp-assigned-address"])).To4(); address != nil {
+			env = append(env, "ip="+address.String())
+			mask := net.IPMask(net.ParseIP(j.String(frame["subnet-mask"])).To4())
+			if mask == nil {
+				mask = address.DefaultMask()
+			}
+			ones, _ := mask.Size()
+			env = append(env, "subnet="+net.IP(mask).String(), "mask="+strconv.Itoa(ones))
+		}
+		for name, option := range map[string]string{
+			"router": "routers", "dns": "domain-name-servers", "domain": "domain-name", "search": "domain-search",
+			"hostname": "hostname", "lease": "address-lease-time", "serverid": "server-identifier", "mtu": "interface-mtu",
+			"staticroutes": "classless-route", "ntpsrv": "ntp-servers",
+		} {
+			if value, exists := frame[option]; exists {
+				env = append(env, name+"="+textvalue(value))
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), CLIENT_HOOK_TIMEOUT)
+	cmd := exec.CommandContext(ctx, c.Script, event)
+	cmd.Env, cmd.Stdout, cmd.Stderr = env, os.Stderr, os.Stderr
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+	err := cmd.Run()
+	cancel()
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "hook: killed after " + CLIENT_HOOK_TIMEOUT.String() + " timeout"
+		}
+		return "hook: " + err.Error()
+	}
+
+	return ""
+}
+
+func (c *CLIENT) frame(msgtype string) (frame FRAME) {
+	frame = FRAME{}
+	for name, value := range c.template {
+		frame[name] = value
+	}
+	frame["dhcp-message-type"] = msgtype
+	frame["bootp-transaction-id"] = ustr.HexInt(uint64(uhash.Rand(1<<32-1)), 4)
+	frame["client-hardware-address"] = c.conn.Local.HardwareAddr.String()
+	frame["bootp-broadcast"] = true
+	delete(frame, "bootp-client-address")
+
+	return
+}
+
+// the request is retransmitted (with the same transaction id and an increasing elapsed time) with an exponential backoff
+// (4, 8, 16, 32 and 64 seconds, randomized by -1 to +1 second, RFC 2131 section 4.1), until the handler stops it (the
+// handler being called for each matching reply, and with a nil reply at the end of each retransmission period), or until
+// the (optional) deadline; the elapsed time (unless explicitly set) is counted from the start of the whole exchange
+// (discover included) if any, and the first transmission time is recorded for lease timers computation (RFC 2131
+// section 4.4.1)
+func (c *CLIENT) transmit(frame FRAME, from, to *Addr, deadline time.Time, handler func(FRAME, *Addr) bool) {
+	start, elapsed := time.Now(), frame["bootp-start-time"] == nil
+	origin := start
+	if !c.started.IsZero() {
+		origin = c.started
+	}
+	c.sent = start
+	if c.Deadline > 0 && (deadline.IsZero() || start.Add(c.Deadline).Before(deadline)) {
+		deadline = start.Add(c.Deadline)
+	}
+	for try := 0; try <= c.Retransmissions; try++ {
+		now := time.Now()
+		timeout := now.Add(time.Duration(4<<min(try, 4))*time.Second + time.Duration(uhash.Rand(2001)-1000)*time.Millisecond)
+		if !deadline.IsZero() {
+			if !now.Before(deadline) {
+				break
+			}
+			if deadline.Before(timeout) {
+				timeout = deadline
+			}
+		}
+		if elapsed {
+			frame["bootp-start-time"] = int(now.Sub(origin).Seconds())
+		}
+		packet, err := v4build(frame)
+		if err != nil {
+			bail(err.Error())
+		}
+		source, destination := *from, *to
+		if _, err := c.conn.WriteTo(&source, &destination, packet); err != nil {
+			return
+		}
+		c.conn.SetReadDeadline(timeout)
+		data := make([]byte, 4<<10)
+		for {
+			read, remote, err := c.conn.ReadFrom(data)
+			if err != nil {
+				break
+			}
+			if rframe, err := v4parse(data[:read]); err == nil && rframe["bootp-opcode"] == "reply" &&
+				rframe["client-hardware-address"] == frame["client-hardware-address"] &&
+				rframe["bootp-transaction-id"] == frame["bootp-transaction-id"] {
+				if handler(rframe, remote) {
+					return
+				}
+			}
+		}
+		if handler(nil, nil) {
+			return
+		}
+	}
+}
+
+// the first reply of one of the accepted types is returned
+func (c *CLIENT) exchange(frame FRAME, from, to *Addr, deadline time.Time, accept ...string) (reply FRAME, remote *Addr) {
+	c.transmit(frame, from, to, deadline, func(rframe FRAME, rremote *Addr) bool {
+		for _, msgtype := range accept {
+			if rframe != nil && rframe["dhcp-message-type"] == msgtype {
+				reply, remote = rframe, rremote
+				return true
+			}
+		}
+		return false
+	})
+
+	return
+}
+
+// all replies to the request (e.g. offers to a discover) received until the deadline are returned in reception order,
+// the ones repeated by servers upon retransmissions excepted (without any deadline, gathering stops at the end of the
+// first retransmission period with replies)
+func (c *CLIENT) gather(frame FRAME, from, to *Addr, deadline time.Time) (replies []FRAME) {
+	request, bounded, seen := V4RMSGTYPES[j.String(frame["dhcp-message-type"])], !deadline.IsZero() || c.Deadline > 0, map[string]bool{}
+	c.transmit(frame, from, to, deadline, func(rframe FRAME, rremote *Addr) bool {
+		if rframe == nil {
+			return !bounded && len(replies) != 0
+		}
+		if response := V4MSGTYPES[V4RMSGTYPES[j.String(rframe["dhcp-message-type"])]]; response == nil || response.request != request {
+			return false
+		}
+		if key := j.String(rframe["server-identifier"]) + "/" + j.String(rframe["bootp-assigned-address"]); !seen[key] {
+			seen[key] = true
+			replies = append(replies, rframe)
+		}
+		return false
+	})
+
+	return
+}
+
+func Policy(value string) (policy []string, err error) {
+	for _, criterion := range strings.Split(value, ",") {
+		if criterion = strings.TrimSpace(criterion); criterion == "" {
+			continue
+		}
+		if name, address, found := strings.Cut(criterion, "="); (found && (name != "server" || net.ParseIP(address) == nil)) ||
+			(!found && criterion != "lease" && criterion != "requested") {
+			return nil, errors.New("invalid policy criterion '" + criterion + "'")
+		}
+		policy = append(policy, criterion)
+	}
+
+	return
+}
+
+// offers are ranked by each policy criterion in turn (preferred server, requested address honoured, longest lease),
+// ties being broken by reception order
+func choose(offers []FRAME, policy []string, requested string) FRAME {
+	if len(offers) == 0 {
+		return nil
+	}
+	ranked := append([]FRAME{}, offers...)
+	sort.SliceStable(ranked, func(i, k int) bool {
+		for _, criterion := range policy {
+			first, second := 0.0, 0.0
+			switch name, value, _ := strings.Cut(criterion, "="); name {
+			case "server":
+				if net.ParseIP(j.String(ranked[i]["server-identifier"])).Equal(net.ParseIP(value)) {
+					first = 1
+				}
+				if net.ParseIP(j.String(ranked[k]["server-identifier"])).Equal(net.ParseIP(value)) {
+					second = 1
+				}
+
+			case "requested":
+				if requested != "" && j.String(ranked[i]["bootp-assigned-address"]) == requested {
+					first = 1
+				}
+				if requested != "" && j.String(ranked[k]["bootp-assigned-address"]) == requested {
+					second = 1
+				}
+
+			case "lease":
+				first, second = j.Number(ranked[i]["address-lease-time"]), j.Number(ranked[k]["address-lease-time"])
+			}
+			if first != second {
+				return first > second
+			}
+		}
+		return false
+	})
+
+	return ranked[0]
+}
+
+// waits for the specified duration, handling signals meanwhile (SIGUSR1 forcing a renewal, SIGUSR2 releasing the lease)
+func (c *CLIENT) wait(duration time.Duration) bool {
+	timer := time.NewTimer(max(0, duration))
+	select {
+	case <-timer.C:
+		return true
+
+	case value := <-c.signals:
+		timer.Stop()
+		switch value {
+		case syscall.SIGUSR1:
+			if c.state == "bound" {
+				c.transition("renewing", nil, "signal")
+			}
+
+		case syscall.SIGUSR2:
+			if c.lease != nil {
+				frame := c.frame("release")
+				frame["bootp-client-address"], frame["server-identifier"] = c.address.String(), j.String(c.lease["server-identifier"])
+				delete(frame, "requested-ip-address")
+				delete(frame, "bootp-broadcast")
+				if packet, err := v4build(frame); err == nil {
+					c.conn.WriteTo(&Addr{Addr: c.address}, &Addr{HardwareAddr: c.server.HardwareAddr, Addr: c.server.Addr, Port: c.port}, packet)
+				}
+				c.unbind("released", nil, "signal")
+			}
+			os.Exit(0)
+		}
+		return false
+	}
+}
+
+// newly acknowledged addresses are probed first (RFC 5227), and declined if already in use (RFC 2131 section 3.1.5),
+// the configuration process being restarted after 10 seconds
+func (c *CLIENT) accept(frame FRAME, remote *Addr) {
+	address, reason := net.ParseIP(j.String(frame["bootp-assigned-address"])), ""
+	if c.Probes > 0 && !address.Equal(c.address) {
+		conflict, err := c.conn.Probe(address, c.Probes, c.Wait)
+		if err != nil {
+			reason = "probe: " + err.Error()
+
+		} else if conflict != nil {
+			decline := c.frame("decline")
+			decline["requested-ip-address"], decline["server-identifier"] = address.String(), frame["server-identifier"]
+			decline["message"] = "address in use by " + conflict.String()
+			delete(decline, "parameters-request-list")
+			if packet, err := v4build(decline); err == nil {
+				c.conn.WriteTo(&Addr{}, &Addr{Port: c.port}, packet)
+			}
+			c.unbind("init", frame, "conflict with "+conflict.String())
+			c.wait(10 * time.Second)
+			return
+		}
+	}
+	c.bind(frame, remote, reason)
+}
+
+// lease timers are relative to the request transmission time, T1 and T2 defaulting to 0.5 and 0.875 times the lease
+// duration (RFC 2131 section 4.4.5), and kept in order whatever the server sent
+func timers(frame FRAME, sent time.Time) (renewal, rebinding, expires time.Time) {
+	duration := time.Duration(j.Number(frame["address-lease-time"], 3600)) * time.Second
+	expires = sent.Add(duration)
+	rebinding = sent.Add(time.Duration(j.Number(frame["rebinding-time"], duration.Seconds()*7/8)) * time.Second)
+	if rebinding.After(expires) {
+		rebinding = expires
+	}
+	renewal = sent.Add(time.Duration(j.Number(frame["renewal-time"], duration.Seconds()/2)) * time.Second)
+	if renewal.After(rebinding) {
+		renewal = rebinding
+	}
+
+	return
+}
+
+// unanswered renewing/rebinding requests are retried after half the remaining time until T2/expiration, down to a
+// minimum of 60 seconds (RFC 2131 section 4.4.5), but never past the limit itself
+func retry(limit, now time.Time) time.Duration {
+	remaining := max(0, limit.Sub(now))
+
+	return min(remaining, max(time.Minute, remaining/2))
+}
+
+func (c *CLIENT) bind(frame FRAME, remote *Addr, reason string) {
+	previous := c.address
+	c.lease, c.address = frame, net.ParseIP(j.String(frame["bootp-assigned-address"]))
+	c.renewal, c.rebinding, c.expires = timers(frame, c.sent)
+	c.server = &Addr{Addr: net.ParseIP(j.String(frame["server-identifier"]))}
+	if remote != nil {
+		// unicast renewals are sent to the server through the link-layer address its replies came from (server or relay)
+		c.server.HardwareAddr = remote.HardwareAddr
+	}
+	if err := c.apply(lease2network(frame)); err != nil {
+		reason = because(reason, "configure: "+err.Error())
+	}
+	if err := c.save(); err != nil {
+		reason = because(reason, "store: "+err.Error())
+	}
+	event := "bound"
+	if (c.state == "renewing" || c.state == "rebinding") && previous.Equal(c.address) {
+		event = "renew"
+	}
+	c.transition("bound", frame, because(reason, c.hook(event, frame)))
+}
+
+// a lost lease is announced to the hook script with a "nak" event (if applicable) followed by a "deconfig" event
+func (c *CLIENT) unbind(state string, frame FRAME, reason string) {
+	if j.String(frame["dhcp-message-type"]) == "nak" {
+		reason = because(reason, c.hook("nak", frame))
+	}
+	if err := c.apply(nil); err != nil {
+		reason = because(reason, "deconfigure: "+err.Error())
+	}
+	if c.lease != nil {
+		reason = because(reason, c.hook("deconfig", nil))
+	}
+	if c.store != "" {
+		os.Remove(c.store)
+	}
+	c.transition(state, frame, reason)
+	c.lease, c.address, c.offer = nil, nil, nil
+}
+
+// the last acknowledged lease is atomically stored, to be verified on next start (INIT-REBOOT)
+func (c *CLIENT) save() error {
+	if c.store == "" {
+		return nil
+	}
+	content, _ := json.Marshal(c.lease)
+
+	return replace(c.store, content)
+}
+
+func (c *CLIENT) load() string {
+	if c.store == "" {
+		return ""
+	}
+	lease := FRAME{}
+	if content, err := os.ReadFile(c.store); err == nil && json.Unmarshal(content, &lease) == nil {
+		return j.String(lease["bootp-assigned-address"])
+	}
+
+	return ""
+}
+
+// classless static routes replace the routers option altogether when present (RFC 3442)
+func lease2network(frame FRAME) (network *NETWORK) {
+	address, mask := net.ParseIP(j.String(frame["bootp-assigned-address"])).To4(), net.IPMask(net.ParseIP(j.String(frame["subnet-mask"])).To4())
+	if address == nil {
+		return nil
+	}
+	if mask == nil {
+		mask = address.DefaultMask()
+	}
+	network = &NETWORK{Address: &net.IPNet{IP: address, Mask: mask}, MTU: int(j.Number(frame["interface-mtu"]))}
+
+	if routes, ok := frame["classless-route"].([]any); ok && len(routes) != 0 {
+		for _, route := range routes {
+			if destination, gateway, found := strings.Cut(j.String(route), ":"); found {
+				if _, destination, err := net.ParseCIDR(destination); err == nil && net.ParseIP(gateway) != nil {
+					network.Routes = append(network.Routes, ROUTE{Destination: destination, Gateway: net.ParseIP(gateway).To4()})
+				}
+			}
+		}
+
+	} else if routers, ok := frame["routers"].([]any); ok && len(routers) != 0 {
+		if gateway := net.ParseIP(j.String(routers[0])).To4(); gateway != nil {
+			network.Routes = append(network.Routes, ROUTE{Destination: &net.IPNet{IP: net.IPv4zero.To4(), Mask: net.CIDRMask(0, 32)}, Gateway: gateway})
+		}
+	}
+
+	return
+}
+
+func (n *NETWORK) Equal(other *NETWORK) bool {
+	if n == nil || other == nil {
+		return n == other
+	}
+	if n.Address.String() != other.Address.String() || n.MTU != other.MTU || len(n.Routes) != len(other.Routes) {
+		return false
+	}
+	for index, route := range n.Routes {
+		if route.Destination.String() != other.Routes[index].Destination.String() || !route.Gateway.Equal(other.Routes[index].Gateway) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// the interface is only reconfigured when the lease network settings change, previous settings being removed first
+// (the original interface MTU is restored when the lease is lost)
+func (c *CLIENT) apply(network *NETWORK) (err error) {
+	if !c.Configure || c.network.Equal(network) {
+		return nil
+	}
+
+	device := c.conn.Local.Device
+	if previous := c.network; previous != nil {
+		for index := len(previous.Routes) - 1; index >= 0; index-- {
+			InterfaceRoute(device, previous.Routes[index].Destination, previous.Routes[index].Gateway, false)
+		}
+		if network == nil || network.Address.String() != previous.Address.String() {
+			if derr := InterfaceAddress(device, previous.Address, false); derr != nil && err == nil {
+				err = derr
+			}
+		}
+		if c.mtu != 0 && (network == nil || network.MTU < 68) {
+			if derr := InterfaceMTU(device, c.mtu); derr != nil && err == nil {
+				err = derr
+			}
+			c.mtu = 0
+		}
+	}
+	c.network = nil
+	if network == nil {
+		return
+	}
+
+	if network.MTU >= 68 {
+		if c.mtu == 0 {
+			if iface, ierr := net.InterfaceByName(device); ierr == nil {
+				c.mtu = iface.MTU
+			}
+		}
+		if err := InterfaceMTU(device, network.MTU); err != nil {
+			return err
+		}
+	}
+	if err := InterfaceAddress(device, network.Address, true); err != nil {
+		return err
+	}
+	c.network = network
+	for _, route := range network.Routes {
+		if rerr := InterfaceRoute(device, route.Destination, route.Gateway, true); rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+
+	return
+}
+
+// RFC 2131 section 4.4 client state machine
+func (c *CLIENT) Run(requested string) {
+	broadcast := &Addr{Port: c.port}
+	c.transition("init", nil, c.hook("deconfig", nil))
+	if requested == "" {
+		requested = c.load()
+	}
+	if requested != "" {
+		c.transition("init-reboot", nil, "")
+	}
+	for {
+		switch c.state {
+		case "init":
+			c.transition("selecting", nil, "")
+
+		case "selecting":
+			var offer FRAME
+			c.started = time.Now()
+			if c.Policy != nil {
+				offer = choose(c.gather(c.frame("discover"), &Addr{}, broadcast, time.Time{}), c.Policy, j.String(c.template["requested-ip-address"]))
+
+			} else {
+				offer, _ = c.exchange(c.frame("discover"), &Addr{}, broadcast, time.Time{}, "offer")
+			}
+			if offer == nil {
+				c.started = time.Time{}
+				c.transition("init", nil, because("no offer", c.hook("leasefail", nil)))
+				c.wait(10 * time.Second)
+				continue
+			}
+			c.offer = offer
+			c.transition("requesting", offer, "")
+
+		// the request is sent with the offer transaction id (RFC 2131 section 4.4.1 and table 5)
+		case "requesting":
+			frame := c.frame("request")
+			frame["bootp-transaction-id"] = c.offer["bootp-transaction-id"]
+			frame["requested-ip-address"], frame["server-identifier"] = c.offer["bootp-assigned-address"], c.offer["server-identifier"]
+			reply, remote := c.exchange(frame, &Addr{}, broadcast, time.Time{}, "ack", "nak")
+			c.started = time.Time{}
+			if reply == nil {
+				c.unbind("init", nil, because("no ack", c.hook("leasefail", nil)))
+				continue
+			}
+			if reply["dhcp-message-type"] == "nak" {
+				c.unbind("init", reply, "nak")
+				c.wait(3 * time.Second)
+				continue
+			}
+			c.accept(reply, remote)
+
+		// a previous address is only verified for a short while (two transmissions) before falling back to discovery
+		case "init-reboot":
+			frame := c.frame("request")
+			frame["requested-ip-address"] = requested
+			delete(frame, "server-identifier")
+			reply, remote := c.exchange(frame, &Addr{}, broadcast, time.Now().Add(CLIENT_REBOOT_TIMEOUT), "ack", "nak")
+			if reply == nil || reply["dhcp-message-type"] == "nak" {
+				c.unbind("init", reply, j.String(reply["dhcp-message-type"], "no ack"))
+				continue
+			}
+			c.accept(reply, remote)
+
+		case "bound":
+			if c.wait(time.Until(c.renewal)) {
+				c.transition("renewing", nil, "")
+			}
+
+		case "renewing", "rebinding":
+			if c.state == "renewing" && !time.Now().Before(c.rebinding) {
+				c.transition("rebinding", nil, "")
+			}
+			if !time.Now().Before(c.expires) {
+				c.unbind("init", nil, "expired")
+				continue
+			}
+
+			// renewals are unicast to the leasing server, rebinding requests broadcast to any server
+			frame := c.frame("request")
+			frame["bootp-client-address"] = c.address.String()
+			delete(frame, "requested-ip-address")
+			delete(frame, "server-identifier")
+			delete(frame, "bootp-broadcast")
+			to, limit := broadcast, c.rebinding
+			if c.state == "renewing" {
+				to = &Addr{HardwareAddr: c.server.HardwareAddr, Addr: c.server.Addr, Port: c.port}
+
+			} else {
+				limit = c.expires
+			}
+			reply, remote := c.exchange(frame, &Addr{Addr: c.address}, to, limit, "ack", "nak")
+			if reply == nil {
+				c.wait(retry(limit, time.Now()))
+				continue
+			}
+			if reply["dhcp-message-type"] == "nak" {
+				c.unbind("init", reply, "nak")
+				continue
+			}
+			c.accept(reply, remote)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+)
+
+func TestLease2network(t *testing.T) {
+	if lease2network(FRAME{"routers": []any{"10.0.0.1"}}) != nil {
+		t.Errorf("network built without an assigned address")
+	}
+
+	// the default mask applies without a subnet mask, the first router becoming the default route
+	network := lease2network(FRAME{"bootp-assigned-address": "10.0.0.17", "routers": []any{"10.0.0.1", "10.0.0.2"}, "interface-mtu": 1400})
+	if network == nil || network.Address.String() != "10.0.0.17/8" || network.MTU != 1400 || len(network.Routes) != 1 ||
+		network.Routes[0].Destination.String() != "0.0.0.0/0" || network.Routes[0].Gateway.String() != "10.0.0.1" {
+		t.Errorf("routers network = %+v", network)
+	}
+
+	// classless static routes replace the routers option altogether (RFC 3442)
+	network = lease2network(FRAME{
+		"bootp-assigned-address": "192.168.1.17",
+		"subnet-mask":            "255.255.255.0",
+		"routers":                []any{"192.168.1.1"},
+		"classless-route":        []any{"10.0.0.0/8:192.168.1.254", "0.0.0.0/0:192.168.1.2", "invalid"},
+	})
+	if network == nil || network.Address.String() != "192.168.1.17/24" || len(network.Routes) != 2 ||
+		network.Routes[0].Destination.String() != "10.0.0.0/8" || network.Routes[0].Gateway.String() != "192.168.1.254" ||
+		network.Routes[1].Destination.String() != "0.0.0.0/0" || network.Routes[1].Gateway.String() != "192.168.1.2" {
+		t.Errorf("classless network = %+v", network)
+	}
+
+	if !network.Equal(lease2network(FRAME{"bootp-assigned-address": "192.168.1.17", "subnet-mask": "255.255.255.0", "classless-route": []any{"10.0.0.0/8:192.168.1.254", "0.0.0.0/0:192.168.1.2"}})) ||
+		network.Equal(nil) || !(*NETWORK)(nil).Equal(nil) {
+		t.Errorf("network comparison failed")
+	}
+}
+
+func TestPolicy(t *testing.T) {
+	for _, test := range []struct {
+		value    string
+		expected string
+		ok       bool
+	}{
+		{"", "", true},
+		{"lease", "lease", true},
+		{" server=10.0.0.1 , requested,lease", "server=10.0.0.1 requested lease", true},
+		{"server=invalid", "", false},
+		{"client=10.0.0.1", "", false},
+		{"fastest", "", false},
+	} {
+		policy, err := Policy(test.value)
+		if (err == nil) != test.ok || strings.Join(policy, " ") != test.expected {
+			t.Errorf("Policy(%q) = %v, %v", test.value, policy, err)
+		}
+	}
+}
+
+func TestChoose(t *testing.T) {
+	offers := []FRAME{
+		{"server-identifier": "10.0.0.1", "bootp-assigned-address": "10.0.0.11", "address-lease-time": 600},
+		{"server-identifier": "10.0.0.2", "bootp-assigned-address": "10.0.0.12", "address-lease-time": 3600},
+		{"server-identifier": "10.0.0.3", "bootp-assigned-address": "10.0.0.13", "address-lease-time": 3600},
+	}
+	for _, test := range []struct {
+		policy    []string
+		requested string
+		expected  string
+	}{
+		{nil, "", "10.0.0.1"},
+		{[]string{"lease"}, "", "10.0.0.2"},
+		{[]string{"server=10.0.0.3"}, "", "10.0.0.3"},
+		{[]string{"server=10.0.0.9", "lease"}, "", "10.0.0.2"},
+		{[]string{"requested", "lease"}, "10.0.0.11", "10.0.0.1"},
+		{[]string{"requested", "lease"}, "10.0.0.99", "10.0.0.2"},
+		{[]string{"lease", "requested"}, "10.0.0.13", "10.0.0.3"},
+	} {
+		if offer := choose(offers, test.policy, test.requested); j.String(offer["server-identifier"]) != test.expected {
+			t.Errorf("choose(%v, %s) = %v, expected %s", test.policy, test.requested, offer["server-identifier"], test.expected)
+		}
+	}
+	if choose(nil, []string{"lease"}, "") != nil {
+		t.Errorf("offer chosen among none")
+	}
+}
+
+func TestTimers(t *testing.T) {
+	sent := time.Unix(1000000, 0)
+	for _, test := range []struct {
+		frame                       FRAME
+		renewal, rebinding, expires int64
+	}{
+		{FRAME{}, 1800, 3150, 3600},
+		{FRAME{"address-lease-time": 600}, 300, 525, 600},
+		{FRAME{"address-lease-time": 600, "renewal-time": 100, "rebinding-time": 200}, 100, 200, 600},
+		{FRAME{"address-lease-time": 600, "renewal-time": 400, "rebinding-time": 300}, 300, 300, 600},
+		{FRAME{"address-lease-time": 600, "rebinding-time": 900}, 300, 600, 600},
+		{FRAME{"address-lease-time": 600, "renewal-time": 900}, 525, 525, 600},
+	} {
+		renewal, rebinding, expires := timers(test.frame, sent)
+		if renewal.Sub(sent) != time.Duration(test.renewal)*time.Second || rebinding.Sub(sent) != time.Duration(test.rebinding)*time.Second ||
+			expires.Sub(sent) != time.Duration(test.expires)*time.Second {
+			t.Errorf("timers(%v) = %v, %v, %v", test.frame, renewal.Sub(sent), rebinding.Sub(sent), expires.Sub(sent))
+		}
+	}
+}
+
+func TestRetry(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		remaining, wait time.Duration
+	}{
+		{time.Hour, 30 * time.Minute},
+		{4 * time.Minute, 2 * time.Minute},
+		{90 * time.Second, time.Minute},
+		{time.Minute, time.Minute},
+		{30 * time.Second, 30 * time.Second},
+		{0, 0},
+		{-time.Minute, 0},
+	} {
+		if wait := retry(now.Add(test.remaining), now); wait != test.wait {
+			t.Errorf("retry(%v) = %v", test.remaining, wait)
+		}
+	}
+}
+
+func TestHook(t *testing.T) {
+	script := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\n[ \"$1\" = bound ] && [ \"$interface\" = eth0 ] && [ \"$ip\" = 10.0.0.10 ] && [ \"$mask\" = 24 ]\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	client := &CLIENT{SETTINGS: SETTINGS{Script: script}, conn: &Conn{Local: &Addr{Device: "eth0"}}}
+	frame := FRAME{"bootp-assigned-address": "10.0.0.10", "subnet-mask": "255.255.255.0"}
+	if reason := client.hook("bound", frame); reason != "" {
+		t.Errorf("hook(bound) = %s", reason)
+	}
+	if reason := client.hook("renew", frame); !strings.HasPrefix(reason, "hook: exit status") {
+		t.Errorf("hook(renew) = %s", reason)
+	}
+	if reason := (&CLIENT{conn: client.conn}).hook("bound", frame); reason != "" {
+		t.Errorf("hook without script = %s", reason)
+	}
+}
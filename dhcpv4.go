@@ -1,6 +1,8 @@
 package main
 
 import (
+	"crypto/hmac"
+	"crypto/md5"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
@@ -10,6 +12,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	j "github.com/pyke369/golang-support/jsonrpc"
 	"github.com/pyke369/golang-support/rcache"
@@ -411,6 +414,10 @@ func v4parse(packet []byte) (frame FRAME, err error) {
 	if opcode := V4OPCODES[packet[0]]; opcode == "" {
 		return nil, errors.New("invalid opcode " + strconv.Itoa(int(packet[0])))
 
+	} else if packet[1] == 0 && packet[2] == 0 {
+		// leasequeries by address or client identifier carry no hardware address (RFC 4388)
+		frame["bootp-opcode"] = opcode
+
 	} else {
 		if hwtype := V4HWTYPES[packet[1]]; hwtype == nil || int(packet[2]) > 16 || (hwtype.length != 0 && int(packet[2]) != hwtype.length) {
 			return nil, errors.New("invalid address type " + strconv.Itoa(int(packet[1])))
@@ -634,6 +641,55 @@ func v4key(frame FRAME) string {
 	return key
 }
 
+func v4client(frame FRAME) string {
+	if value := j.String(frame["client-identifier"]); value != "" {
+		return value
+	}
+
+	return j.String(frame["client-hardware-address"])
+}
+
+// RFC 6704 authentication option (protocol 3, HMAC-MD5 algorithm, monotonic counter replay detection),
+// carrying either the forcerenew nonce (type 1) or the message digest (type 2)
+func v4auth(kind byte, value []byte) string {
+	auth := make([]byte, 12, 12+len(value))
+	auth[0], auth[1], auth[11] = 3, 1, kind
+	binary.BigEndian.PutUint64(auth[3:], uint64(time.Now().UnixNano()))
+
+	return hex.EncodeToString(append(auth, value...))
+}
+
+// the digest is computed over the whole message with the hops and relay address fields zeroed (RFC 3118 section 2),
+// only HMAC-MD5 digest options being signed
+func v4sign(packet []byte, nonce string) bool {
+	key, err := hex.DecodeString(nonce)
+	if err != nil || len(packet) < 240 {
+		return false
+	}
+	for offset := 240; offset+1 < len(packet) && packet[offset] != 0xff; {
+		if packet[offset] == 0 {
+			offset++
+			continue
+		}
+		size := int(packet[offset+1])
+		if packet[offset] != 90 || size != 28 || offset+2+size > len(packet) || packet[offset+2] != 3 || packet[offset+3] != 1 || packet[offset+13] != 2 {
+			offset += 2 + size
+			continue
+		}
+		digest := packet[offset+14 : offset+30]
+		clear(digest)
+		data := append([]byte{}, packet...)
+		data[3] = 0
+		clear(data[24:28])
+		mac := hmac.New(md5.New, key)
+		mac.Write(data)
+		copy(digest, mac.Sum(nil))
+		return true
+	}
+
+	return false
+}
+
 func v4build(frame FRAME) (packet []byte, err error) {
 	packet = make([]byte, 4<<10)
 	dhcp := true
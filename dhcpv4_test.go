@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"testing"
+)
+
+func TestV4sign(t *testing.T) {
+	nonce := "00112233445566778899aabbccddeeff"
+	built, err := v4build(FRAME{
+		"dhcp-message-type":       "forcerenew",
+		"bootp-transaction-id":    "01020304",
+		"bootp-relay-address":     "10.0.0.1",
+		"bootp-relay-hops":        1,
+		"client-hardware-address": "00:11:22:33:44:55",
+		"authentication":          v4auth(2, make([]byte, 16)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// leading pad options must be skipped one byte at a time
+	packet := append(append(append([]byte{}, built[:240]...), 0, 0, 0), built[240:]...)
+
+	offset := bytes.Index(packet[240:], []byte{90, 28, 3, 1}) + 240
+	if offset < 240 || !v4sign(packet, nonce) {
+		t.Fatalf("authentication option not signed")
+	}
+	data := append([]byte{}, packet...)
+	data[3] = 0
+	clear(data[24:28])
+	clear(data[offset+14 : offset+30])
+	key, _ := hex.DecodeString(nonce)
+	mac := hmac.New(md5.New, key)
+	mac.Write(data)
+	if !bytes.Equal(packet[offset+14:offset+30], mac.Sum(nil)) {
+		t.Errorf("digest mismatch")
+	}
+
+	// only the HMAC-MD5 algorithm is signed
+	packet[offset+3] = 2
+	if v4sign(packet, nonce) {
+		t.Errorf("unknown algorithm signed")
+	}
+	if v4sign(packet[:240], nonce) || v4sign(built, "invalid") {
+		t.Errorf("packet without authentication or invalid nonce signed")
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+	"github.com/pyke369/golang-support/ulog"
+)
+
+const (
+	FAILOVER_PORT     = 647
+	FAILOVER_TIMEOUT  = 5 * time.Second
+	FAILOVER_INTERVAL = time.Second
+)
+
+// RFC 3074 section 6 permutation table
+var FAILOVER_PERMUTATION = [256]byte{
+	251, 175, 119, 215, 81, 14, 79, 191, 103, 49, 181, 143, 186, 157, 0, 232, 31, 32, 55, 60, 152, 58, 17, 237, 174, 70,
+	160, 144, 220, 90, 57, 223, 59, 3, 18, 140, 111, 166, 203, 196, 134, 243, 124, 95, 222, 179, 197, 65, 180, 48, 36, 15,
+	107, 46, 233, 130, 165, 30, 123, 161, 209, 23, 97, 16, 40, 91, 219, 61, 100, 10, 210, 109, 250, 127, 22, 138, 29, 108,
+	244, 67, 207, 9, 178, 204, 74, 98, 126, 249, 167, 116, 34, 77, 193, 200, 121, 5, 20, 113, 71, 35, 128, 13, 182, 94,
+	25, 226, 227, 199, 75, 27, 41, 245, 230, 224, 43, 225, 177, 26, 155, 150, 212, 142, 218, 115, 241, 73, 88, 105, 39, 114,
+	62, 255, 192, 201, 145, 214, 168, 158, 221, 148, 154, 122, 12, 84, 82, 163, 44, 139, 228, 236, 205, 242, 217, 11, 187, 146,
+	159, 64, 86, 239, 195, 42, 106, 198, 118, 112, 184, 172, 87, 2, 173, 117, 176, 229, 247, 253, 137, 185, 99, 164, 102, 147,
+	45, 66, 231, 52, 141, 211, 194, 206, 246, 238, 56, 110, 78, 248, 63, 240, 189, 93, 92, 51, 53, 183, 19, 171, 72, 50,
+	33, 104, 101, 69, 8, 252, 83, 120, 76, 135, 85, 54, 202, 125, 188, 213, 96, 235, 136, 208, 162, 129, 190, 132, 156, 38,
+	47, 1, 7, 254, 24, 4, 216, 131, 89, 21, 28, 133, 37, 153, 149, 80, 170, 68, 6, 169, 234, 151,
+}
+
+type FMESSAGE struct {
+	Type     string `json:"type"`
+	Node     string `json:"node,omitempty"`
+	Role     string `json:"role,omitempty"`
+	Lease    *LEASE `json:"lease,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	Sequence int64  `json:"sequence,omitempty"`
+	MAC      string `json:"mac,omitempty"`
+}
+
+type FAILOVER struct {
+	role    string
+	local   string
+	partner string
+	secret  string
+	safe    time.Duration
+	node    string
+	engine  *ENGINE
+	logger  *ulog.ULog
+	state   string
+	since   time.Time
+	updates chan *LEASE
+	mu      sync.RWMutex
+}
+
+// -F <role>,<local address>,<partner address>[,<safe period>]
+func NewFailover(value, secret, node string, engine *ENGINE, logger *ulog.ULog) (failover *FAILOVER, err error) {
+	parts := strings.Split(value, ",")
+	failover = &FAILOVER{
+		role:    strings.TrimSpace(parts[0]),
+		secret:  secret,
+		safe:    time.Hour,
+		node:    node,
+		engine:  engine,
+		logger:  logger,
+		state:   "startup",
+		since:   time.Now(),
+		updates: make(chan *LEASE, 4<<10),
+	}
+	if failover.role != "primary" && failover.role != "secondary" {
+		return nil, errors.New("invalid failover role " + failover.role)
+	}
+	if len(parts) < 3 {
+		return nil, errors.New("missing failover local or partner address")
+	}
+	if failover.local, err = faddress(parts[1]); err != nil {
+		return nil, errors.New("invalid failover local address " + parts[1])
+	}
+	if failover.partner, err = faddress(parts[2]); err != nil {
+		return nil, errors.New("invalid failover partner address " + parts[2])
+	}
+	if len(parts) > 3 {
+		seconds, err := strconv.Atoi(strings.TrimSpace(parts[3]))
+		if err != nil || seconds < 10 {
+			return nil, errors.New("invalid failover safe period " + parts[3])
+		}
+		failover.safe = time.Duration(seconds) * time.Second
+	}
+	engine.notify = failover.notify
+
+	return failover, nil
+}
+
+// partners addresses must be explicit IP addresses (the failover port being used if none is specified)
+func faddress(value string) (address string, err error) {
+	value = strings.TrimSpace(value)
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		host, port = value, strconv.Itoa(FAILOVER_PORT)
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsUnspecified() {
+		return "", errors.New("invalid address")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", errors.New("invalid port")
+	}
+
+	return net.JoinHostPort(ip.String(), port), nil
+}
+
+func (f *FAILOVER) index() int {
+	if f.role == "primary" {
+		return 0
+	}
+
+	return 1
+}
+
+func (f *FAILOVER) transition(state string) {
+	f.mu.Lock()
+	if f.state == state {
+		f.mu.Unlock()
+		return
+	}
+	f.state, f.since = state, time.Now()
+	f.mu.Unlock()
+
+	// addresses are split between partners, unless one of them takes over the whole pools
+	if state == "partner-down" {
+		f.engine.Share(0, 0)
+		f.logger.Warn(map[string]any{"event": "failover", "state": state, "role": f.role})
+
+	} else {
+		f.engine.Share(2, f.index())
+		f.logger.Info(map[string]any{"event": "failover", "state": state, "role": f.role})
+	}
+}
+
+func (f *FAILOVER) notify(lease *LEASE) {
+	select {
+	case f.updates <- lease:
+
+	default:
+		// the partner will be fully resynchronized upon reconnection
+	}
+}
+
+// RFC 3074 Pearson hash of the client identifier (or of the client hardware address if none was provided)
+func fbucket(frame FRAME) byte {
+	key, _ := hex.DecodeString(j.String(frame["client-identifier"]))
+	if len(key) == 0 {
+		key, _ = hex.DecodeString(strings.ReplaceAll(j.String(frame["client-hardware-address"]), ":", ""))
+	}
+	hash := byte(len(key))
+	for index := len(key) - 1; index >= 0; index-- {
+		hash = FAILOVER_PERMUTATION[hash^key[index]]
+	}
+
+	return hash
+}
+
+// requests are load-balanced between partners by hashing clients into 256 buckets (RFC 3074), the primary serving the
+// lower half of them; renewals for leases held locally are still answered while the partner state is unknown
+func (f *FAILOVER) Serve(frame FRAME) bool {
+	f.mu.RLock()
+	state := f.state
+	f.mu.RUnlock()
+	if state == "partner-down" {
+		return true
+	}
+	if (fbucket(frame) < 128) == (f.role == "primary") {
+		return true
+	}
+
+	return state == "interrupted" && f.engine.Holds(frame)
+}
+
+func (f *FAILOVER) State() string {
+	f.mu.RLock()
+	state := f.state
+	f.mu.RUnlock()
+
+	return state
+}
+
+// messages are authenticated with the shared secret (if any), bound to the receiver session nonce and sequenced
+func (f *FAILOVER) sign(message *FMESSAGE, nonce string) {
+	message.MAC = ""
+	if f.secret == "" {
+		return
+	}
+	payload, _ := json.Marshal(message)
+	mac := hmac.New(sha256.New, []byte(f.secret))
+	mac.Write([]byte(nonce))
+	mac.Write(payload)
+	message.MAC = hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f *FAILOVER) verify(message *FMESSAGE, nonce string) bool {
+	received := message.MAC
+	f.sign(message, nonce)
+	valid := hmac.Equal([]byte(received), []byte(message.MAC))
+	message.MAC = received
+
+	return valid
+}
+
+func (f *FAILOVER) session(conn net.Conn) {
+	remote := conn.RemoteAddr().String()
+	f.logger.Info(map[string]any{"event": "failover", "state": "connected", "role": f.role, "remote": remote})
+	encoder, reader, done := json.NewEncoder(conn), bufio.NewReader(conn), make(chan struct{})
+
+	// both partners first exchange a random nonce, all subsequent messages being signed against the receiver one
+	var hello FMESSAGE
+
+	value := make([]byte, 16)
+	rand.Read(value)
+	nonce, sequence := hex.EncodeToString(value), int64(0)
+	conn.SetWriteDeadline(time.Now().Add(FAILOVER_TIMEOUT))
+	conn.SetReadDeadline(time.Now().Add(FAILOVER_TIMEOUT))
+	if encoder.Encode(&FMESSAGE{Type: "hello", Node: f.node, Role: f.role, Nonce: nonce}) != nil {
+		conn.Close()
+		return
+	}
+	if line, err := reader.ReadBytes('\n'); err != nil || json.Unmarshal(line, &hello) != nil || hello.Type != "hello" || hello.Nonce == "" {
+		f.logger.Warn(map[string]any{"event": "failover", "role": f.role, "remote": remote, "reason": "invalid partner hello"})
+		conn.Close()
+		return
+	}
+	if hello.Role == f.role {
+		f.logger.Warn(map[string]any{"event": "failover", "role": f.role, "remote": remote, "reason": "partner has the same role"})
+		conn.Close()
+		return
+	}
+
+	go func() {
+		expected := int64(0)
+		for {
+			var message FMESSAGE
+
+			conn.SetReadDeadline(time.Now().Add(FAILOVER_TIMEOUT))
+			line, err := reader.ReadBytes('\n')
+			if err != nil || json.Unmarshal(line, &message) != nil {
+				break
+			}
+			expected++
+			if message.Sequence != expected || !f.verify(&message, nonce) {
+				f.logger.Warn(map[string]any{"event": "failover", "role": f.role, "remote": remote, "reason": "invalid message authentication"})
+				break
+			}
+			f.transition("normal")
+			if message.Type == "lease" && message.Lease != nil {
+				f.engine.Apply(message.Lease)
+			}
+		}
+		conn.Close()
+		close(done)
+	}()
+
+	send := func(message *FMESSAGE) error {
+		sequence++
+		message.Sequence = sequence
+		f.sign(message, hello.Nonce)
+		conn.SetWriteDeadline(time.Now().Add(FAILOVER_TIMEOUT))
+
+		return encoder.Encode(message)
+	}
+
+	// pending updates are superseded by a full table exchange
+	for len(f.updates) > 0 {
+		<-f.updates
+	}
+	for _, lease := range f.engine.Dump() {
+		if send(&FMESSAGE{Type: "lease", Lease: lease}) != nil {
+			break
+		}
+	}
+
+	ticker := time.NewTicker(FAILOVER_INTERVAL)
+	for {
+		message := &FMESSAGE{Type: "ping"}
+		select {
+		case lease := <-f.updates:
+			message = &FMESSAGE{Type: "lease", Lease: lease}
+
+		case <-ticker.C:
+
+		case <-done:
+			ticker.Stop()
+			f.logger.Warn(map[string]any{"event": "failover", "state": "disconnected", "role": f.role, "remote": remote})
+			f.transition("interrupted")
+			return
+		}
+		if send(message) != nil {
+			conn.Close()
+		}
+	}
+}
+
+func (f *FAILOVER) Run() {
+	f.transition("interrupted")
+
+	// the partner is considered down (and its share of clients and addresses taken over) after the safe period
+	go func() {
+		for range time.Tick(time.Second) {
+			f.mu.RLock()
+			expired := f.state == "interrupted" && time.Since(f.since) >= f.safe
+			f.mu.RUnlock()
+			if expired {
+				f.transition("partner-down")
+			}
+		}
+	}()
+
+	if f.secret == "" {
+		f.logger.Warn(map[string]any{"event": "failover", "role": f.role, "reason": "no shared secret, partner messages are not authenticated"})
+	}
+	local, _, _ := net.SplitHostPort(f.local)
+	partner, _, _ := net.SplitHostPort(f.partner)
+
+	if f.role == "primary" {
+		listener, err := net.Listen("tcp", f.local)
+		if err != nil {
+			bail(err.Error())
+		}
+		f.logger.Info(map[string]any{"event": "bind", "bind": f.local, "mode": "failover"})
+		go func() {
+			for {
+				if conn, err := listener.Accept(); err == nil {
+					// only the configured partner may connect, and a single session is handled at once
+					if remote, _, _ := net.SplitHostPort(conn.RemoteAddr().String()); !net.ParseIP(remote).Equal(net.ParseIP(partner)) {
+						f.logger.Warn(map[string]any{"event": "failover", "role": f.role, "remote": conn.RemoteAddr().String(), "reason": "unexpected partner address"})
+						conn.Close()
+
+					} else {
+						f.session(conn)
+					}
+				}
+			}
+		}()
+		return
+	}
+
+	go func() {
+		dialer, backoff := net.Dialer{Timeout: FAILOVER_TIMEOUT, LocalAddr: &net.TCPAddr{IP: net.ParseIP(local)}}, time.Second
+		for {
+			if conn, err := dialer.Dial("tcp", f.partner); err == nil {
+				backoff = time.Second
+				f.session(conn)
+
+			} else {
+				f.logger.Warn(map[string]any{"event": "failover", "role": f.role, "remote": f.partner, "reason": err.Error()})
+			}
+			time.Sleep(backoff)
+			backoff = min(30*time.Second, backoff*2)
+		}
+	}()
+}
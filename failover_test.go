@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/pyke369/golang-support/ulog"
+)
+
+func TestFailoverPermutation(t *testing.T) {
+	seen := map[byte]bool{}
+	for _, value := range FAILOVER_PERMUTATION {
+		seen[value] = true
+	}
+	if len(seen) != 256 {
+		t.Errorf("permutation table holds %d distinct values", len(seen))
+	}
+}
+
+func TestFbucket(t *testing.T) {
+	hardware := FRAME{"client-hardware-address": "00:11:22:33:44:55"}
+	if fbucket(hardware) != fbucket(FRAME{"client-hardware-address": "00:11:22:33:44:55"}) {
+		t.Errorf("hash is not stable")
+	}
+	// the client identifier takes precedence over the hardware address
+	identified := FRAME{"client-hardware-address": "00:11:22:33:44:55", "client-identifier": "ff0011223344"}
+	if fbucket(identified) != fbucket(FRAME{"client-identifier": "ff0011223344"}) {
+		t.Errorf("client identifier not used as key")
+	}
+
+	// single-byte key: hash = T[1 ^ key]
+	if bucket := fbucket(FRAME{"client-identifier": "07"}); bucket != FAILOVER_PERMUTATION[1^7] {
+		t.Errorf("fbucket(07) = %d", bucket)
+	}
+
+	// clients spread over both halves
+	buckets := map[bool]int{}
+	for index := 0; index < 256; index++ {
+		buckets[fbucket(FRAME{"client-hardware-address": fmt.Sprintf("00:11:22:33:44:%02x", index)}) < 128]++
+	}
+	if buckets[true] < 64 || buckets[false] < 64 {
+		t.Errorf("unbalanced buckets %v", buckets)
+	}
+}
+
+func TestFaddress(t *testing.T) {
+	for _, test := range []struct {
+		value, address string
+	}{
+		{"192.168.40.1", "192.168.40.1:647"},
+		{" 192.168.40.1:8647 ", "192.168.40.1:8647"},
+		{"[fd00::1]:647", "[fd00::1]:647"},
+		{"*:647", ""},
+		{"0.0.0.0", ""},
+		{"partner.example.com:647", ""},
+		{"192.168.40.1:port", ""},
+	} {
+		address, err := faddress(test.value)
+		if address != test.address || (err == nil) != (test.address != "") {
+			t.Errorf("faddress(%s) = %s, %v", test.value, address, err)
+		}
+	}
+}
+
+func TestNewFailover(t *testing.T) {
+	for _, test := range []struct {
+		value string
+		fail  bool
+	}{
+		{"primary,192.168.40.1,192.168.40.2", false},
+		{"secondary,192.168.40.2,192.168.40.1:647,600", false},
+		{"primary,192.168.40.1", true},
+		{"primary,*:647,192.168.40.2", true},
+		{"secondary,192.168.40.2,192.168.40.1,5", true},
+		{"tertiary,192.168.40.1,192.168.40.2", true},
+	} {
+		if _, err := NewFailover(test.value, "secret", "", testengine(t), ulog.New("")); (err != nil) != test.fail {
+			t.Errorf("NewFailover(%s) = %v", test.value, err)
+		}
+	}
+}
+
+func TestFailoverSign(t *testing.T) {
+	failover := &FAILOVER{secret: "secret"}
+	message := &FMESSAGE{Type: "lease", Sequence: 1, Lease: &LEASE{Address: "10.0.0.10", Pool: "lan", State: "bound"}}
+	failover.sign(message, "nonce")
+	if len(message.MAC) != 64 || !failover.verify(message, "nonce") {
+		t.Fatalf("valid message rejected: %+v", message)
+	}
+	if failover.verify(message, "other") {
+		t.Errorf("message accepted for another session")
+	}
+	if (&FAILOVER{secret: "other"}).verify(message, "nonce") {
+		t.Errorf("message accepted with another secret")
+	}
+	message.Lease.State = "free"
+	if failover.verify(message, "nonce") {
+		t.Errorf("altered message accepted")
+	}
+
+	// messages are neither signed nor checked without a shared secret
+	message = &FMESSAGE{Type: "ping", Sequence: 1}
+	(&FAILOVER{}).sign(message, "nonce")
+	if message.MAC != "" || !(&FAILOVER{}).verify(message, "nonce") {
+		t.Errorf("unauthenticated message = %+v", message)
+	}
+}
+
+func TestFailoverSession(t *testing.T) {
+	for _, test := range []struct {
+		secrets    [2]string
+		replicated bool
+	}{
+		{[2]string{"secret", "secret"}, true},
+		{[2]string{"", ""}, true},
+		{[2]string{"secret", "other"}, false},
+		{[2]string{"secret", ""}, false},
+	} {
+		engines := [2]*ENGINE{testengine(t), testengine(t)}
+		address, _ := v4uint("10.0.0.10")
+		lease := &LEASE{Address: "10.0.0.10", Client: "01aabbccddeeff", Pool: "lan", State: "bound", Expires: time.Now().Unix() + 3600}
+		engines[0].set(engines[0].pools[0], address, lease)
+		engines[0].touch(lease)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		conns, done := [2]net.Conn{}, make(chan struct{}, 2)
+		if conns[1], err = net.Dial("tcp", listener.Addr().String()); err != nil {
+			t.Fatal(err)
+		}
+		if conns[0], err = listener.Accept(); err != nil {
+			t.Fatal(err)
+		}
+		listener.Close()
+		for index, role := range []string{"primary", "secondary"} {
+			failover, err := NewFailover(role+",127.0.0.1,127.0.0.1", test.secrets[index], role, engines[index], ulog.New(""))
+			if err != nil {
+				t.Fatal(err)
+			}
+			go func(conn net.Conn) {
+				failover.session(conn)
+				done <- struct{}{}
+			}(conns[index])
+		}
+
+		replicated := false
+		for start := time.Now(); time.Since(start) < 2*time.Second && !replicated; time.Sleep(10 * time.Millisecond) {
+			replicated = len(engines[1].Dump()) != 0
+		}
+		if replicated != test.replicated {
+			t.Errorf("secrets %v: replicated = %t", test.secrets, replicated)
+		}
+		conns[0].Close()
+		conns[1].Close()
+		<-done
+		<-done
+	}
+}
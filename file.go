@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+	"github.com/pyke369/golang-support/ulog"
+)
+
+type SUBNET struct {
+	network  *net.IPNet
+	defaults FRAME
+}
+
+type LEASES struct {
+	Subnets map[string]FRAME `json:"subnets"`
+	Hosts   map[string]FRAME `json:"hosts"`
+	subnets []*SUBNET
+}
+
+// hosts are keyed by hex-encoded client identifiers or hardware addresses, whatever their separators or case
+func hostkey(value string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "").Replace(value))
+}
+
+func loadleases(path string) (leases *LEASES, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	leases = &LEASES{}
+	if err = json.Unmarshal(content, leases); err != nil {
+		return nil, err
+	}
+	for name, defaults := range leases.Subnets {
+		_, network, err := net.ParseCIDR(name)
+		if err != nil || network.IP.To4() == nil {
+			return nil, errors.New("invalid subnet " + name)
+		}
+		leases.subnets = append(leases.subnets, &SUBNET{network: network, defaults: defaults})
+	}
+	// most specific subnets first
+	sort.Slice(leases.subnets, func(i, j int) bool {
+		ilength, _ := leases.subnets[i].network.Mask.Size()
+		jlength, _ := leases.subnets[j].network.Mask.Size()
+		return ilength > jlength
+	})
+	hosts := map[string]FRAME{}
+	for name, frame := range leases.Hosts {
+		hosts[hostkey(name)] = frame
+	}
+	leases.Hosts = hosts
+
+	return
+}
+
+func modified(path string, last os.FileInfo) (os.FileInfo, bool) {
+	if info, err := os.Stat(path); err == nil && (last == nil || !info.ModTime().Equal(last.ModTime()) || info.Size() != last.Size()) {
+		return info, true
+	}
+
+	return last, false
+}
+
+func (l *LEASES) Lookup(frame FRAME) (reply FRAME) {
+	var host FRAME
+	if value := j.String(frame["client-identifier"]); value != "" {
+		host = l.Hosts[hostkey(value)]
+	}
+	if host == nil {
+		host = l.Hosts[hostkey(j.String(frame["client-hardware-address"]))]
+	}
+	if host == nil {
+		return nil
+	}
+
+	reply = FRAME{}
+	address := net.ParseIP(j.String(frame["bootp-relay-address"], j.String(frame["source-address"])))
+	for _, subnet := range l.subnets {
+		if address != nil && subnet.network.Contains(address) {
+			for name, value := range subnet.defaults {
+				reply[name] = value
+			}
+			break
+		}
+	}
+	for name, value := range host {
+		reply[name] = value
+	}
+
+	return
+}
+
+func filebackend(backend string, requests *QUEUE, dispatch func(*ENVELOPE, string, string, string, map[string]any), release func(FRAME), logger *ulog.ULog) {
+	remote, err := url.Parse(backend)
+	if err != nil {
+		bail(err.Error())
+	}
+	path := remote.Path
+	leases, err := loadleases(path)
+	if err != nil {
+		bail(err.Error())
+	}
+	info, changed := modified(path, nil)
+	logger.Info(map[string]any{"event": "start", "local": path, "hosts": len(leases.Hosts), "subnets": len(leases.subnets)})
+
+	// the file is polled for changes and reloaded in place, the previous content being kept if invalid
+	reload := time.NewTicker(2 * time.Second)
+	for {
+		select {
+		case <-reload.C:
+			if info, changed = modified(path, info); changed {
+				if updated, err := loadleases(path); err == nil {
+					leases = updated
+					logger.Info(map[string]any{"event": "reload", "local": path, "hosts": len(leases.Hosts), "subnets": len(leases.subnets)})
+
+				} else {
+					logger.Warn(map[string]any{"event": "reload", "local": path, "reason": err.Error()})
+				}
+			}
+
+		case frame := <-requests.output:
+			msgtype := j.String(frame["dhcp-message-type"])
+			if msgtype != "discover" && msgtype != "request" && msgtype != "inform" {
+				release(frame)
+				continue
+			}
+			reply := leases.Lookup(frame)
+			if reply == nil {
+				requests.Drop(frame, "unknown client")
+				release(frame)
+				continue
+			}
+
+			switch msgtype {
+			case "discover":
+				reply["dhcp-message-type"] = "offer"
+
+			case "request":
+				reply["dhcp-message-type"] = "ack"
+				requested := j.String(frame["requested-ip-address"], j.String(frame["bootp-client-address"]))
+				if requested != "" && requested != "0.0.0.0" && requested != j.String(reply["bootp-assigned-address"]) {
+					reply = FRAME{"dhcp-message-type": "nak"}
+				}
+
+			case "inform":
+				reply["dhcp-message-type"] = "ack"
+				delete(reply, "bootp-assigned-address")
+				delete(reply, "address-lease-time")
+			}
+			dispatch(&ENVELOPE{Frame: reply}, v4key(frame), "file", backend, map[string]any{"local": path})
+		}
+	}
+}
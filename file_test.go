@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+)
+
+func TestLookup(t *testing.T) {
+	leases, err := loadleases(filepath.Join("support", "hosts.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name     string
+		frame    FRAME
+		address  string
+		hostname string
+		domain   string
+	}{
+		{"unknown", FRAME{"client-hardware-address": "00:50:56:3a:c2:99"}, "", "", ""},
+		{"hardware", FRAME{"client-hardware-address": "00:50:56:3A:C2:66"}, "192.168.40.150", "server01", ""},
+		{"identifier", FRAME{"client-hardware-address": "00:50:56:3a:c2:99", "client-identifier": "010050563ac267"}, "192.168.40.151", "server02", ""},
+		{"unknown identifier", FRAME{"client-hardware-address": "00:50:56:3a:c2:66", "client-identifier": "ff0011"}, "192.168.40.150", "server01", ""},
+		{"relayed", FRAME{"client-hardware-address": "00:50:56:3a:c2:66", "bootp-relay-address": "192.168.40.1"}, "192.168.40.150", "server01", "domain.com"},
+		{"local", FRAME{"client-hardware-address": "00:50:56:3a:c2:66", "source-address": "192.168.40.254"}, "192.168.40.150", "server01", "domain.com"},
+		{"other subnet", FRAME{"client-hardware-address": "00:50:56:3a:c2:66", "bootp-relay-address": "10.0.0.1"}, "192.168.40.150", "server01", ""},
+	} {
+		reply := leases.Lookup(test.frame)
+		if (reply == nil) != (test.address == "") || j.String(reply["bootp-assigned-address"]) != test.address ||
+			j.String(reply["hostname"]) != test.hostname || j.String(reply["domain-name"]) != test.domain {
+			t.Errorf("%s: Lookup = %v", test.name, reply)
+		}
+	}
+}
+
+func TestLookupOverlay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "hosts.json")
+	if err := os.WriteFile(path, []byte(`{
+		"subnets": {
+			"10.0.0.0/8":  { "domain-name": "wide.com", "address-lease-time": 600 },
+			"10.1.0.0/16": { "domain-name": "narrow.com", "address-lease-time": 3600, "routers": [ "10.1.0.1" ] }
+		},
+		"hosts": { "00-11-22-33-44-55": { "bootp-assigned-address": "10.1.0.10", "address-lease-time": 60 } }
+	}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	leases, err := loadleases(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the most specific subnet defaults apply, host values taking precedence
+	reply := leases.Lookup(FRAME{"client-hardware-address": "00:11:22:33:44:55", "bootp-relay-address": "10.1.2.3"})
+	if j.String(reply["domain-name"]) != "narrow.com" || j.Number(reply["address-lease-time"]) != 60 || reply["routers"] == nil {
+		t.Errorf("Lookup = %v", reply)
+	}
+	reply = leases.Lookup(FRAME{"client-hardware-address": "00:11:22:33:44:55", "bootp-relay-address": "10.2.0.1"})
+	if j.String(reply["domain-name"]) != "wide.com" || j.Number(reply["address-lease-time"]) != 60 || reply["routers"] != nil {
+		t.Errorf("Lookup = %v", reply)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"subnets":{"invalid":{}}}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadleases(path); err == nil {
+		t.Errorf("invalid subnet accepted")
+	}
+}
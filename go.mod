@@ -1,8 +1,17 @@
 module github.com/pyke369/pdhcp
 
-go 1.25
+go 1.25.0
 
 require (
 	github.com/pyke369/golang-support v0.0.0-20250907181608-f391d5af3e55
-	golang.org/x/sys v0.36.0
+	go.starlark.net v0.0.0-20260908191801-89a6a09411d5
+	golang.org/x/sys v0.47.0
+	google.golang.org/grpc v1.84.0
+	google.golang.org/protobuf v1.36.11
+)
+
+require (
+	golang.org/x/net v0.57.0 // indirect
+	golang.org/x/text v0.40.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20260706201446-f0a921348800 // indirect
 )
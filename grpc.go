@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+	"github.com/pyke369/golang-support/ulog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/keepalive"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// see support/pdhcp.proto: each message holds a single JSON envelope, in both directions
+const GRPC_METHOD = "/pdhcp.Backend/Exchange"
+
+var GRPC_STREAM = &grpc.StreamDesc{StreamName: "Exchange", ServerStreams: true, ClientStreams: true}
+
+func grpcbackend(backend string, config *tls.Config, requests *QUEUE, wrap func(FRAME) any, handle func(*ENVELOPE, string, string, map[string]any), logger *ulog.ULog) {
+	remote, err := url.Parse(backend)
+	if err != nil {
+		bail(err.Error())
+	}
+	credential := insecure.NewCredentials()
+	if remote.Scheme == "grpcs" {
+		credential = credentials.NewTLS(config)
+	}
+	conn, err := grpc.NewClient(remote.Host,
+		grpc.WithTransportCredentials(credential),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{Time: 30 * time.Second, Timeout: 10 * time.Second}),
+	)
+	if err != nil {
+		bail(err.Error())
+	}
+	remote.User, remote.RawQuery = nil, ""
+
+	backoff := time.Second
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		if stream, err := conn.NewStream(ctx, GRPC_STREAM, GRPC_METHOD); err == nil {
+			logger.Info(map[string]any{"event": "start", "remote": remote.String()})
+			backoff = time.Second
+			done := make(chan error, 1)
+
+			go func() {
+				for {
+					message := &wrapperspb.BytesValue{}
+					if err := stream.RecvMsg(message); err != nil {
+						done <- err
+						break
+					}
+					if reply, err := unwrap(message.Value); err == nil {
+						handle(reply, "grpc", backend, map[string]any{"remote": remote.String()})
+					}
+				}
+			}()
+
+		loop:
+			for {
+				select {
+				case frame := <-requests.output:
+					// flow control is achieved by the underlying HTTP/2 stream: frames are kept in the requests
+					// queue (and dropped if needed) while the backend is not able to handle more of them
+					if payload, err := json.Marshal(wrap(frame)); err == nil {
+						if err := stream.SendMsg(&wrapperspb.BytesValue{Value: payload}); err != nil {
+							requests.Push(frame)
+							break loop
+						}
+						logger.Info(map[string]any{
+							"event":  "send",
+							"type":   j.String(frame["dhcp-message-type"]),
+							"txid":   j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"]),
+							"remote": remote.String(),
+						})
+					}
+
+				case err := <-done:
+					logger.Warn(map[string]any{"event": "stop", "remote": remote.String(), "reason": err.Error()})
+					break loop
+				}
+			}
+			cancel()
+
+		} else {
+			cancel()
+			logger.Warn(map[string]any{"event": "start", "remote": remote.String(), "reason": err.Error()})
+		}
+		time.Sleep(backoff)
+		backoff = min(30*time.Second, backoff*2)
+	}
+}
@@ -0,0 +1,843 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math/bits"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+	"github.com/pyke369/golang-support/ulog"
+)
+
+// reply fields owned by the leases engine, which backends consulted for options cannot override
+var LEASE_FIELDS = []string{"dhcp-message-type", "bootp-assigned-address", "address-lease-time", "renewal-time", "rebinding-time", "message", "authentication"}
+
+type LEASE struct {
+	Address  string `json:"address"`
+	Client   string `json:"client,omitempty"`
+	Hardware string `json:"hardware,omitempty"`
+	Hostname string `json:"hostname,omitempty"`
+	Agent    string `json:"agent,omitempty"`
+	Relay    string `json:"relay,omitempty"`
+	Local    string `json:"local,omitempty"`
+	Nonce    string `json:"nonce,omitempty"`
+	Pool     string `json:"pool"`
+	State    string `json:"state"`
+	Expires  int64  `json:"expires"`
+	Updated  int64  `json:"updated"`
+	Version  int64  `json:"version,omitempty"`
+}
+
+type POOLCONFIG struct {
+	Name    string   `json:"name"`
+	Network string   `json:"network"`
+	Ranges  []string `json:"ranges"`
+	Exclude []string `json:"exclude"`
+	Options FRAME    `json:"options"`
+}
+
+type POOL struct {
+	name     string
+	network  *net.IPNet
+	base     uint32
+	size     int
+	excluded []uint64
+	busy     []uint64
+	cursor   int
+	used     int
+	capacity int
+	options  FRAME
+	duration int
+}
+
+type ENGINE struct {
+	Store   string        `json:"store"`
+	Offer   int           `json:"offer"`
+	Decline int           `json:"decline"`
+	Pools   []*POOLCONFIG `json:"pools"`
+	pools   []*POOL
+	leases  map[uint32]*LEASE
+	freed   map[uint32]*LEASE
+	clients map[string]uint32
+	server  string
+	dirty   bool
+	split   int
+	share   int
+	notify  func(*LEASE)
+	logger  *ulog.ULog
+	mu      sync.Mutex
+}
+
+func v4uint(value string) (uint32, bool) {
+	if address := net.ParseIP(strings.TrimSpace(value)).To4(); address != nil {
+		return binary.BigEndian.Uint32(address), true
+	}
+
+	return 0, false
+}
+
+func v4string(value uint32) string {
+	return net.IPv4(byte(value>>24), byte(value>>16), byte(value>>8), byte(value)).String()
+}
+
+func v4span(value string) (first, last uint32, ok bool) {
+	parts := strings.SplitN(value, "-", 2)
+	if first, ok = v4uint(parts[0]); !ok {
+		return
+	}
+	last = first
+	if len(parts) > 1 {
+		if last, ok = v4uint(parts[1]); !ok || last < first {
+			return 0, 0, false
+		}
+	}
+
+	return first, last, true
+}
+
+func NewPool(config *POOLCONFIG) (pool *POOL, err error) {
+	_, network, err := net.ParseCIDR(config.Network)
+	if err != nil || network.IP.To4() == nil {
+		return nil, errors.New("invalid pool network " + config.Network)
+	}
+	ones, _ := network.Mask.Size()
+	if ones < 12 || ones > 30 {
+		return nil, errors.New("unsupported pool network size " + config.Network)
+	}
+	pool = &POOL{
+		name:    j.String(config.Name, config.Network),
+		network: network,
+		base:    binary.BigEndian.Uint32(network.IP.To4()),
+		size:    1 << (32 - ones),
+		options: FRAME{},
+	}
+	for name, value := range config.Options {
+		pool.options[name] = value
+	}
+	if _, exists := pool.options["subnet-mask"]; !exists {
+		pool.options["subnet-mask"] = net.IP(network.Mask).String()
+	}
+	pool.duration = int(j.Number(pool.options["address-lease-time"], 86400))
+	delete(pool.options, "address-lease-time")
+
+	// addresses outside the configured ranges (as well as the network and broadcast addresses) are never allocated
+	pool.excluded, pool.busy = make([]uint64, (pool.size+63)/64), make([]uint64, (pool.size+63)/64)
+	ranges := config.Ranges
+	if len(ranges) == 0 {
+		ranges = []string{v4string(pool.base+1) + "-" + v4string(pool.base+uint32(pool.size)-2)}
+	}
+	for index := range pool.size {
+		pool.excluded[index/64] |= 1 << (index % 64)
+	}
+	for _, value := range ranges {
+		first, last, ok := v4span(value)
+		if !ok || !pool.contains(first) || !pool.contains(last) {
+			return nil, errors.New("invalid pool range " + value)
+		}
+		pool.exclude(first, last, false)
+	}
+	for _, value := range config.Exclude {
+		first, last, ok := v4span(value)
+		if !ok {
+			return nil, errors.New("invalid pool exclusion " + value)
+		}
+		pool.exclude(first, last, true)
+	}
+	for _, word := range pool.excluded {
+		pool.capacity += 64 - bits.OnesCount64(word)
+	}
+	pool.capacity -= len(pool.excluded)*64 - pool.size
+
+	return pool, nil
+}
+
+func (p *POOL) contains(address uint32) bool {
+	return address >= p.base && address-p.base < uint32(p.size)
+}
+
+// spans are clamped to the pool addresses (network and broadcast addresses always staying excluded)
+func (p *POOL) exclude(first, last uint32, excluded bool) {
+	first, last = max(first, p.base), min(last, p.base+uint32(p.size-1))
+	if first > last {
+		return
+	}
+	for address := first; ; address++ {
+		if offset := int(address - p.base); excluded {
+			p.excluded[offset/64] |= 1 << (offset % 64)
+
+		} else if offset > 0 && offset < p.size-1 {
+			p.excluded[offset/64] &^= 1 << (offset % 64)
+		}
+		if address == last {
+			break
+		}
+	}
+}
+
+func (p *POOL) available(address uint32) bool {
+	if !p.contains(address) {
+		return false
+	}
+	offset := int(address - p.base)
+
+	return (p.excluded[offset/64]|p.busy[offset/64])&(1<<(offset%64)) == 0
+}
+
+func (p *POOL) mark(address uint32, busy bool) {
+	offset := int(address - p.base)
+	if busy && p.busy[offset/64]&(1<<(offset%64)) == 0 {
+		p.busy[offset/64] |= 1 << (offset % 64)
+		p.used++
+
+	} else if !busy && p.busy[offset/64]&(1<<(offset%64)) != 0 {
+		p.busy[offset/64] &^= 1 << (offset % 64)
+		p.used--
+	}
+}
+
+// addresses may be split among several servers allocating from the same pool (see failover)
+func (p *POOL) owned(address uint32, split, share int) bool {
+	return split == 0 || int(address-p.base)%split == share
+}
+
+// next-fit allocation, skipping fully used or excluded 64-addresses words
+func (p *POOL) allocate(split, share int) (uint32, bool) {
+	words := len(p.busy)
+	for count := 0; count <= words; count++ {
+		word := (p.cursor/64 + count) % words
+		for mask := ^(p.excluded[word] | p.busy[word]); mask != 0; mask &= mask - 1 {
+			offset := word*64 + bits.TrailingZeros64(mask)
+			if offset < p.size && p.owned(p.base+uint32(offset), split, share) {
+				p.cursor = offset + 1
+				return p.base + uint32(offset), true
+			}
+		}
+	}
+
+	return 0, false
+}
+
+func NewEngine(path string, logger *ulog.ULog) (engine *ENGINE, err error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	engine = &ENGINE{Offer: 30, Decline: 3600, leases: map[uint32]*LEASE{}, freed: map[uint32]*LEASE{}, clients: map[string]uint32{}, logger: logger}
+	if err = json.Unmarshal(content, engine); err != nil {
+		return nil, err
+	}
+	engine.Offer, engine.Decline = min(300, max(5, engine.Offer)), min(86400, max(60, engine.Decline))
+	for _, config := range engine.Pools {
+		pool, err := NewPool(config)
+		if err != nil {
+			return nil, err
+		}
+		for _, other := range engine.pools {
+			if other.name == pool.name {
+				return nil, errors.New("duplicate pool name " + pool.name)
+			}
+		}
+		engine.pools = append(engine.pools, pool)
+	}
+	if len(engine.pools) == 0 {
+		return nil, errors.New("no pool defined in " + path)
+	}
+
+	if engine.Store != "" {
+		if content, err := os.ReadFile(engine.Store); err == nil {
+			leases, now := map[string]*LEASE{}, time.Now().Unix()
+			if err := json.Unmarshal(content, &leases); err != nil {
+				return nil, errors.New("invalid leases store " + engine.Store + " (" + err.Error() + ")")
+			}
+			for _, lease := range leases {
+				if address, ok := v4uint(lease.Address); ok && lease.Expires > now {
+					if pool := engine.pool(lease.Pool); pool != nil && pool.contains(address) {
+						if lease.State == "free" {
+							engine.freed[address] = lease
+
+						} else {
+							engine.set(pool, address, lease)
+						}
+					}
+				}
+			}
+
+		} else if !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+
+	go func() {
+		for range time.Tick(time.Second) {
+			engine.expire()
+			engine.save()
+		}
+	}()
+
+	return engine, nil
+}
+
+func (e *ENGINE) pool(name string) *POOL {
+	for _, pool := range e.pools {
+		if pool.name == name {
+			return pool
+		}
+	}
+
+	return nil
+}
+
+func (e *ENGINE) set(pool *POOL, address uint32, lease *LEASE) {
+	pool.mark(address, true)
+	e.leases[address] = lease
+	delete(e.freed, address)
+	if lease.Client != "" {
+		e.clients[lease.Client] = address
+	}
+	e.dirty = true
+}
+
+// local changes are versioned and notified (to the failover partner)
+func (e *ENGINE) touch(lease *LEASE) {
+	now := time.Now()
+	lease.Updated, lease.Version, e.dirty = now.Unix(), max(now.UnixNano(), lease.Version+1), true
+	if e.notify != nil {
+		value := *lease
+		e.notify(&value)
+	}
+}
+
+// released addresses are remembered (until the original lease would have expired) so that a resync with the failover
+// partner cannot bring them back
+func (e *ENGINE) free(address uint32) {
+	if lease := e.leases[address]; lease != nil {
+		e.unset(address)
+		e.freed[address] = &LEASE{Address: lease.Address, Pool: lease.Pool, State: "free", Expires: lease.Expires, Version: lease.Version}
+		e.touch(e.freed[address])
+	}
+}
+
+func (e *ENGINE) unset(address uint32) {
+	if lease := e.leases[address]; lease != nil {
+		if pool := e.pool(lease.Pool); pool != nil {
+			pool.mark(address, false)
+		}
+		if e.clients[lease.Client] == address {
+			delete(e.clients, lease.Client)
+		}
+		delete(e.leases, address)
+		e.dirty = true
+	}
+}
+
+func (e *ENGINE) expire() {
+	now := time.Now().Unix()
+	e.mu.Lock()
+	for address, lease := range e.leases {
+		if lease.Expires <= now {
+			e.unset(address)
+			if lease.State == "bound" {
+				e.logger.Info(map[string]any{"event": "lease", "state": "expired", "address": lease.Address, "client": lease.Client, "pool": lease.Pool})
+			}
+		}
+	}
+	for address, lease := range e.freed {
+		if lease.Expires <= now {
+			delete(e.freed, address)
+			e.dirty = true
+		}
+	}
+	e.mu.Unlock()
+}
+
+// the content is written to a temporary file, flushed to disk and renamed over the target (the directory being flushed
+// as well), so that neither a partially written file nor a lost rename may ever be read back after a crash
+func replace(path string, content []byte) error {
+	handle, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = handle.Write(content); err == nil {
+		err = handle.Sync()
+	}
+	if cerr := handle.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		os.Remove(path + ".tmp")
+		return err
+	}
+	if directory, err := os.Open(filepath.Dir(path)); err == nil {
+		err = directory.Sync()
+		directory.Close()
+		return err
+	}
+
+	return nil
+}
+
+// the store is atomically replaced (no partially written file may ever be read back)
+func (e *ENGINE) save() {
+	e.mu.Lock()
+	if e.Store == "" || !e.dirty {
+		e.mu.Unlock()
+		return
+	}
+	leases := map[string]*LEASE{}
+	for _, lease := range e.freed {
+		value := *lease
+		leases[lease.Address] = &value
+	}
+	for _, lease := range e.leases {
+		value := *lease
+		leases[lease.Address] = &value
+	}
+	e.dirty = false
+	e.mu.Unlock()
+
+	content, _ := json.Marshal(leases)
+	if err := replace(e.Store, content); err != nil {
+		e.logger.Warn(map[string]any{"event": "lease", "store": e.Store, "reason": err.Error()})
+		e.mu.Lock()
+		e.dirty = true
+		e.mu.Unlock()
+	}
+}
+
+// pools serving a request are matched on the relay address, or on the receiving interface address for direct requests
+func (e *ENGINE) match(frame FRAME) (pools []*POOL) {
+	if address, ok := v4uint(j.String(frame["bootp-relay-address"], j.String(frame["source-address"]))); ok {
+		for _, pool := range e.pools {
+			if pool.contains(address) {
+				pools = append(pools, pool)
+			}
+		}
+	}
+
+	return
+}
+
+// bound clients location (for server-initiated messages) and forcerenew nonce (RFC 6704, generated once per lease
+// for clients supporting the HMAC-MD5 algorithm)
+func (e *ENGINE) track(lease *LEASE, frame FRAME) {
+	lease.Relay, lease.Local = j.String(frame["bootp-relay-address"]), j.String(frame["source-address"])
+	if agent := j.String(frame["relay-agent-information"]); agent != "" {
+		lease.Agent = agent
+	}
+	if algorithms, _ := hex.DecodeString(j.String(frame["forcerenew-nonce-capable"])); bytes.IndexByte(algorithms, 1) >= 0 {
+		if lease.Nonce == "" {
+			nonce := make([]byte, 16)
+			rand.Read(nonce)
+			lease.Nonce = hex.EncodeToString(nonce)
+		}
+
+	} else {
+		lease.Nonce = ""
+	}
+}
+
+func (e *ENGINE) reply(pool *POOL, lease *LEASE, msgtype string) (reply FRAME) {
+	reply = FRAME{}
+	for name, value := range pool.options {
+		reply[name] = value
+	}
+	reply["dhcp-message-type"] = msgtype
+	if lease != nil {
+		reply["bootp-assigned-address"] = lease.Address
+		reply["address-lease-time"] = pool.duration
+		if _, exists := reply["renewal-time"]; !exists {
+			reply["renewal-time"] = pool.duration / 2
+		}
+		if _, exists := reply["rebinding-time"]; !exists {
+			reply["rebinding-time"] = pool.duration * 7 / 8
+		}
+		if msgtype == "ack" && lease.Nonce != "" {
+			nonce, _ := hex.DecodeString(lease.Nonce)
+			reply["authentication"] = v4auth(1, nonce)
+		}
+	}
+
+	return
+}
+
+// the server identifier (RFC 2131 section 4.3.1) defaults to the listening address if specific, then to the address the
+// request was received on, then to the local address the relay is reached from (pools may override it)
+func (e *ENGINE) identifier(frame FRAME) string {
+	if e.server != "" {
+		return e.server
+	}
+	if value := j.String(frame["source-address"]); value != "" {
+		return value
+	}
+	if relay := j.String(frame["bootp-relay-address"]); relay != "" {
+		if conn, err := net.Dial("udp4", net.JoinHostPort(relay, "67")); err == nil {
+			address := conn.LocalAddr().(*net.UDPAddr).IP.String()
+			conn.Close()
+			return address
+		}
+	}
+
+	return ""
+}
+
+func (e *ENGINE) Handle(frame FRAME) (reply FRAME) {
+	e.mu.Lock()
+	reply = e.handle(frame)
+	e.mu.Unlock()
+	if reply != nil && j.String(reply["server-identifier"]) == "" {
+		if value := e.identifier(frame); value != "" {
+			reply["server-identifier"] = value
+		}
+	}
+
+	return
+}
+
+func (e *ENGINE) handle(frame FRAME) FRAME {
+	pools := e.match(frame)
+	client, now := v4client(frame), time.Now().Unix()
+	if len(pools) == 0 || client == "" {
+		return nil
+	}
+
+	var current *LEASE
+	if address, exists := e.clients[client]; exists {
+		current = e.leases[address]
+	}
+	requested, _ := v4uint(j.String(frame["requested-ip-address"]))
+	ciaddr, _ := v4uint(j.String(frame["bootp-client-address"]))
+	log := func(lease *LEASE, state string) {
+		e.logger.Info(map[string]any{"event": "lease", "state": state, "address": lease.Address, "client": lease.Client, "pool": lease.Pool})
+	}
+
+	switch j.String(frame["dhcp-message-type"]) {
+	case "discover":
+		// previous lease first, then requested address, then next free address
+		for _, pool := range pools {
+			if current != nil && current.Pool == pool.name {
+				if current.State != "bound" {
+					current.Expires = now + int64(e.Offer)
+				}
+				e.touch(current)
+				return e.reply(pool, current, "offer")
+			}
+		}
+		if current != nil {
+			address, _ := v4uint(current.Address)
+			e.free(address)
+		}
+		for _, pool := range pools {
+			address, ok := requested, pool.available(requested) && pool.owned(requested, e.split, e.share)
+			if !ok {
+				address, ok = pool.allocate(e.split, e.share)
+			}
+			if ok {
+				lease := &LEASE{
+					Address:  v4string(address),
+					Client:   client,
+					Hardware: j.String(frame["client-hardware-address"]),
+					Hostname: j.String(frame["hostname"]),
+					Agent:    j.String(frame["relay-agent-information"]),
+					Pool:     pool.name,
+					State:    "offered",
+					Expires:  now + int64(e.Offer),
+				}
+				e.set(pool, address, lease)
+				e.touch(lease)
+				log(lease, "offered")
+				return e.reply(pool, lease, "offer")
+			}
+		}
+		e.logger.Warn(map[string]any{"event": "lease", "client": client, "reason": "no free address"})
+
+	case "request":
+		address := requested
+		if address == 0 {
+			address = ciaddr
+		}
+		if address == 0 {
+			return nil
+		}
+		var pool *POOL
+		for _, candidate := range pools {
+			if candidate.contains(address) {
+				pool = candidate
+				break
+			}
+		}
+		if pool == nil {
+			return FRAME{"dhcp-message-type": "nak", "message": "wrong network"}
+		}
+		// the client selected another server's offer (including the failover partner one, whose leases are replicated
+		// here as well), only our own pending offer being released
+		if value := j.String(frame["server-identifier"]); value != "" && value != j.String(pool.options["server-identifier"], e.identifier(frame)) {
+			if current != nil && current.State == "offered" {
+				address, _ := v4uint(current.Address)
+				if pool := e.pool(current.Pool); pool != nil && pool.owned(address, e.split, e.share) {
+					e.free(address)
+				}
+			}
+			return nil
+		}
+
+		lease := e.leases[address]
+		if lease != nil && lease.Client == client && lease.State != "declined" {
+			if lease.State != "bound" {
+				log(lease, "bound")
+			}
+			lease.State, lease.Expires = "bound", now+int64(pool.duration)
+			e.track(lease, frame)
+			e.touch(lease)
+			return e.reply(pool, lease, "ack")
+		}
+
+		// init-reboot or rebinding for an address unknown to us (for instance after a store loss)
+		if lease == nil && pool.available(address) && j.String(frame["server-identifier"]) == "" {
+			if current != nil {
+				address, _ := v4uint(current.Address)
+				e.free(address)
+			}
+			lease = &LEASE{
+				Address:  v4string(address),
+				Client:   client,
+				Hardware: j.String(frame["client-hardware-address"]),
+				Hostname: j.String(frame["hostname"]),
+				Pool:     pool.name,
+				State:    "bound",
+				Expires:  now + int64(pool.duration),
+			}
+			e.track(lease, frame)
+			e.set(pool, address, lease)
+			e.touch(lease)
+			log(lease, "bound")
+			return e.reply(pool, lease, "ack")
+		}
+
+		return FRAME{"dhcp-message-type": "nak", "message": "address not available"}
+
+	case "release":
+		if lease := e.leases[ciaddr]; lease != nil && lease.Client == client {
+			e.free(ciaddr)
+			log(lease, "released")
+		}
+
+	case "decline":
+		// declined addresses are probably used by another host, and kept out of allocation for a while
+		if lease := e.leases[requested]; lease != nil && lease.Client == client {
+			delete(e.clients, client)
+			lease.Client, lease.State, lease.Expires = "", "declined", now+int64(e.Decline)
+			e.touch(lease)
+			e.logger.Warn(map[string]any{"event": "lease", "state": "declined", "address": lease.Address, "client": client, "pool": lease.Pool})
+		}
+
+	case "inform":
+		return e.reply(pools[0], nil, "ack")
+	}
+
+	return nil
+}
+
+// leasequery (RFC 4388) by address (ciaddr), client identifier or hardware address, only accepted from relay agents
+func (e *ENGINE) Query(frame FRAME) (reply FRAME) {
+	if j.String(frame["bootp-relay-address"]) == "" {
+		return nil
+	}
+	e.mu.Lock()
+	reply = e.query(frame)
+	e.mu.Unlock()
+
+	return
+}
+
+func (e *ENGINE) query(frame FRAME) FRAME {
+	now := time.Now().Unix()
+
+	var leases []*LEASE
+	address, byaddress := v4uint(j.String(frame["bootp-client-address"]))
+	if byaddress {
+		if lease := e.leases[address]; lease != nil && lease.State == "bound" {
+			leases = append(leases, lease)
+		}
+
+	} else if client := j.String(frame["client-identifier"]); client != "" {
+		if address, exists := e.clients[client]; exists && e.leases[address].State == "bound" {
+			leases = append(leases, e.leases[address])
+		}
+
+	} else if hardware := strings.ToLower(j.String(frame["client-hardware-address"])); hardware != "" {
+		for _, lease := range e.leases {
+			if lease.State == "bound" && strings.ToLower(lease.Hardware) == hardware {
+				leases = append(leases, lease)
+			}
+		}
+	}
+
+	if len(leases) == 0 {
+		if !byaddress {
+			return FRAME{"dhcp-message-type": "leaseunknown"}
+		}
+		for _, pool := range e.pools {
+			if pool.contains(address) {
+				return FRAME{"dhcp-message-type": "leaseunassigned", "bootp-client-address": v4string(address)}
+			}
+		}
+		return FRAME{"dhcp-message-type": "leaseunknown", "bootp-client-address": v4string(address)}
+	}
+
+	// the most recently updated binding is returned, along with all the client addresses if several
+	lease := leases[0]
+	for _, candidate := range leases {
+		if candidate.Updated > lease.Updated {
+			lease = candidate
+		}
+	}
+	reply := e.binding(lease, now)
+	if len(leases) > 1 {
+		addresses := []any{}
+		for _, lease := range leases {
+			addresses = append(addresses, lease.Address)
+		}
+		reply["associated-addresses"] = addresses
+	}
+
+	return reply
+}
+
+func (e *ENGINE) binding(lease *LEASE, now int64) (reply FRAME) {
+	reply = FRAME{
+		"dhcp-message-type":     "leaseactive",
+		"bootp-client-address":  lease.Address,
+		"address-lease-time":    max(0, lease.Expires-now),
+		"last-transaction-time": max(0, now-lease.Updated),
+	}
+	if lease.Hardware != "" {
+		reply["client-hardware-address"] = lease.Hardware
+	}
+	if lease.Client != "" && lease.Client != lease.Hardware {
+		reply["client-identifier"] = lease.Client
+	}
+
+	return
+}
+
+// bound lease lookup by address or hardware address
+func (e *ENGINE) Find(target string) (lease *LEASE) {
+	e.mu.Lock()
+	if address, ok := v4uint(target); ok {
+		if current := e.leases[address]; current != nil && current.State == "bound" {
+			value := *current
+			lease = &value
+		}
+
+	} else {
+		for _, current := range e.leases {
+			if current.State == "bound" && strings.EqualFold(current.Hardware, target) {
+				value := *current
+				lease = &value
+				break
+			}
+		}
+	}
+	e.mu.Unlock()
+
+	return
+}
+
+// whether the request renews (or rebinds) a lease bound to the same client
+func (e *ENGINE) Holds(frame FRAME) (held bool) {
+	if j.String(frame["dhcp-message-type"]) != "request" {
+		return false
+	}
+	address, _ := v4uint(j.String(frame["bootp-client-address"]))
+	if address == 0 {
+		address, _ = v4uint(j.String(frame["requested-ip-address"]))
+	}
+	e.mu.Lock()
+	if lease := e.leases[address]; lease != nil && lease.State == "bound" && lease.Client == v4client(frame) {
+		held = true
+	}
+	e.mu.Unlock()
+
+	return
+}
+
+func (e *ENGINE) Share(split, share int) {
+	e.mu.Lock()
+	e.split, e.share = split, share
+	e.mu.Unlock()
+}
+
+func (e *ENGINE) Dump() (leases []*LEASE) {
+	e.mu.Lock()
+	for _, lease := range e.leases {
+		value := *lease
+		leases = append(leases, &value)
+	}
+	for _, lease := range e.freed {
+		value := *lease
+		leases = append(leases, &value)
+	}
+	e.mu.Unlock()
+
+	return
+}
+
+// changes received from the failover partner are only applied if more recent than the local version (and never notified back)
+func (e *ENGINE) Apply(lease *LEASE) {
+	address, ok := v4uint(lease.Address)
+	pool := e.pool(lease.Pool)
+	if !ok || pool == nil || !pool.contains(address) {
+		return
+	}
+	e.mu.Lock()
+	current := e.leases[address]
+	if current == nil {
+		current = e.freed[address]
+	}
+	if current == nil || lease.Version > current.Version {
+		e.unset(address)
+		delete(e.freed, address)
+		if lease.Expires > time.Now().Unix() {
+			value := *lease
+			if lease.State == "free" {
+				e.freed[address] = &value
+
+			} else {
+				if previous, exists := e.clients[lease.Client]; exists && lease.Client != "" {
+					e.unset(previous)
+				}
+				e.set(pool, address, &value)
+			}
+		}
+		e.dirty = true
+	}
+	e.mu.Unlock()
+}
+
+func (e *ENGINE) Stats() (stats []any) {
+	e.mu.Lock()
+	for _, pool := range e.pools {
+		stats = append(stats, map[string]any{
+			"name":  pool.name,
+			"size":  pool.capacity,
+			"used":  pool.used,
+			"usage": pool.used * 100 / max(1, pool.capacity),
+		})
+	}
+	e.mu.Unlock()
+
+	return
+}
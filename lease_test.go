@@ -0,0 +1,233 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+	"github.com/pyke369/golang-support/ulog"
+)
+
+func TestV4span(t *testing.T) {
+	for _, test := range []struct {
+		value       string
+		first, last string
+		ok          bool
+	}{
+		{"10.0.0.1", "10.0.0.1", "10.0.0.1", true},
+		{"10.0.0.1-10.0.0.9", "10.0.0.1", "10.0.0.9", true},
+		{"10.0.0.9-10.0.0.1", "", "", false},
+		{"10.0.0.1-invalid", "", "", false},
+		{"0.0.0.0-255.255.255.255", "0.0.0.0", "255.255.255.255", true},
+	} {
+		first, last, ok := v4span(test.value)
+		if ok != test.ok || (ok && (v4string(first) != test.first || v4string(last) != test.last)) {
+			t.Errorf("v4span(%s) = %s, %s, %t", test.value, v4string(first), v4string(last), ok)
+		}
+	}
+}
+
+func TestNewPool(t *testing.T) {
+	for _, test := range []struct {
+		config   POOLCONFIG
+		capacity int
+		fail     bool
+	}{
+		{POOLCONFIG{Network: "192.168.1.0/24"}, 254, false},
+		{POOLCONFIG{Network: "192.168.1.0/24", Ranges: []string{"192.168.1.100-192.168.1.199"}}, 100, false},
+		{POOLCONFIG{Network: "192.168.1.0/24", Ranges: []string{"192.168.1.0-192.168.1.255"}}, 254, false},
+		{POOLCONFIG{Network: "192.168.1.0/24", Exclude: []string{"192.168.1.1", "192.168.1.250-192.168.2.10"}}, 248, false},
+		{POOLCONFIG{Network: "192.168.1.0/24", Exclude: []string{"0.0.0.0-255.255.255.255"}}, 0, false},
+		{POOLCONFIG{Network: "192.168.1.0/24", Exclude: []string{"10.0.0.0-10.255.255.255"}}, 254, false},
+		{POOLCONFIG{Network: "255.255.255.0/24", Exclude: []string{"255.255.255.128-255.255.255.255"}}, 127, false},
+		{POOLCONFIG{Network: "192.168.1.0/24", Ranges: []string{"192.168.2.1-192.168.2.9"}}, 0, true},
+		{POOLCONFIG{Network: "192.168.1.0/24", Exclude: []string{"192.168.1.9-192.168.1.1"}}, 0, true},
+		{POOLCONFIG{Network: "10.0.0.0/8"}, 0, true},
+	} {
+		pool, err := NewPool(&test.config)
+		if test.fail {
+			if err == nil {
+				t.Errorf("NewPool(%v) succeeded", test.config)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewPool(%v) failed: %v", test.config, err)
+			continue
+		}
+		if pool.capacity != test.capacity {
+			t.Errorf("NewPool(%v) capacity = %d, expected %d", test.config, pool.capacity, test.capacity)
+		}
+	}
+}
+
+func TestPoolAllocate(t *testing.T) {
+	pool, err := NewPool(&POOLCONFIG{Network: "10.0.0.0/24", Ranges: []string{"10.0.0.10-10.0.0.13"}, Exclude: []string{"10.0.0.11"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocated := []string{}
+	for {
+		address, ok := pool.allocate(0, 0)
+		if !ok {
+			break
+		}
+		if !pool.available(address) {
+			t.Fatalf("allocated unavailable address %s", v4string(address))
+		}
+		pool.mark(address, true)
+		allocated = append(allocated, v4string(address))
+	}
+	if len(allocated) != 3 || allocated[0] != "10.0.0.10" || allocated[1] != "10.0.0.12" || allocated[2] != "10.0.0.13" {
+		t.Errorf("unexpected allocations %v", allocated)
+	}
+	if pool.used != 3 {
+		t.Errorf("used = %d, expected 3", pool.used)
+	}
+
+	// released addresses are allocated again (next-fit)
+	address, _ := v4uint("10.0.0.12")
+	pool.mark(address, false)
+	if next, ok := pool.allocate(0, 0); !ok || next != address {
+		t.Errorf("allocate after release = %s, %t", v4string(next), ok)
+	}
+
+	// split allocation only hands out owned addresses
+	pool, _ = NewPool(&POOLCONFIG{Network: "10.0.0.0/24"})
+	for range 10 {
+		address, ok := pool.allocate(2, 1)
+		if !ok || (address-pool.base)%2 != 1 {
+			t.Fatalf("allocate(2, 1) = %s, %t", v4string(address), ok)
+		}
+		pool.mark(address, true)
+	}
+}
+
+func TestReplace(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "store.json")
+	for _, content := range []string{"{}", `{"10.0.0.1":{}}`} {
+		if err := replace(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		if actual, err := os.ReadFile(path); err != nil || string(actual) != content {
+			t.Errorf("read back %q (%v), expected %q", actual, err, content)
+		}
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("temporary file left behind")
+	}
+}
+
+func testengine(t *testing.T) *ENGINE {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	if err := os.WriteFile(path, []byte(`{"pools":[{"name":"lan","network":"10.0.0.0/24","ranges":["10.0.0.10-10.0.0.20"]}]}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	engine, err := NewEngine(path, ulog.New(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return engine
+}
+
+func TestEngineTombstones(t *testing.T) {
+	engine := testengine(t)
+	address, _ := v4uint("10.0.0.10")
+	bound := &LEASE{Address: "10.0.0.10", Client: "01aabbccddeeff", Pool: "lan", State: "bound", Expires: time.Now().Unix() + 3600}
+	engine.set(engine.pools[0], address, bound)
+	engine.touch(bound)
+	stale := *bound
+	engine.free(address)
+
+	leases := engine.Dump()
+	if len(leases) != 1 || leases[0].State != "free" || leases[0].Version <= stale.Version {
+		t.Fatalf("dump after release = %+v", leases)
+	}
+	engine.Apply(&stale)
+	if engine.leases[address] != nil || engine.Holds(FRAME{"dhcp-message-type": "request", "bootp-client-address": "10.0.0.10", "client-identifier": "01aabbccddeeff"}) {
+		t.Errorf("released lease re-created by an older version")
+	}
+
+	renewed := stale
+	renewed.Version = leases[0].Version + 1
+	engine.Apply(&renewed)
+	if lease := engine.leases[address]; lease == nil || lease.State != "bound" || engine.freed[address] != nil {
+		t.Errorf("newer lease not applied over the tombstone")
+	}
+	if !engine.Holds(FRAME{"dhcp-message-type": "request", "bootp-client-address": "10.0.0.10", "client-identifier": "01aabbccddeeff"}) {
+		t.Errorf("renewal for a bound lease not held")
+	}
+
+	released := renewed
+	released.State, released.Version = "free", renewed.Version+1
+	engine.Apply(&released)
+	if engine.leases[address] != nil || engine.freed[address] == nil || engine.pools[0].used != 0 {
+		t.Errorf("newer tombstone not applied")
+	}
+
+	released.Version, released.Expires = released.Version+1, time.Now().Unix()-1
+	engine.Apply(&released)
+	if engine.freed[address] != nil {
+		t.Errorf("expired tombstone kept")
+	}
+}
+
+func TestEngineServerIdentifier(t *testing.T) {
+	engine := testengine(t)
+	engine.server = "10.0.0.1"
+	request := func(msgtype, server string) FRAME {
+		frame := FRAME{"dhcp-message-type": msgtype, "bootp-relay-address": "10.0.0.254", "client-hardware-address": "00:11:22:33:44:55"}
+		if msgtype == "request" {
+			frame["requested-ip-address"] = "10.0.0.10"
+		}
+		if server != "" {
+			frame["server-identifier"] = server
+		}
+		return frame
+	}
+
+	for _, test := range []struct {
+		frame    FRAME
+		expected string
+		state    string
+	}{
+		{request("discover", ""), "offer", "offered"},
+		{request("request", "10.0.0.2"), "", ""},
+		{request("discover", ""), "offer", "offered"},
+		{request("request", "10.0.0.1"), "ack", "bound"},
+		{request("request", "10.0.0.1"), "ack", "bound"},
+	} {
+		reply := engine.Handle(test.frame)
+		if j.String(reply["dhcp-message-type"]) != test.expected || (reply != nil && j.String(reply["server-identifier"]) != "10.0.0.1") {
+			t.Errorf("%v: reply %v", test.frame, reply)
+		}
+		state := ""
+		if lease := engine.leases[engine.clients["00:11:22:33:44:55"]]; lease != nil {
+			state = lease.State
+		}
+		if state != test.state {
+			t.Errorf("%v: lease state %q, expected %q", test.frame, state, test.state)
+		}
+	}
+
+	// a selecting request for an unknown address is refused by the named server, and ignored by others
+	frame := request("request", "10.0.0.1")
+	frame["client-hardware-address"], frame["requested-ip-address"] = "00:11:22:33:44:66", "10.0.0.11"
+	if reply := engine.Handle(frame); j.String(reply["dhcp-message-type"]) != "nak" || j.String(reply["server-identifier"]) != "10.0.0.1" {
+		t.Errorf("unknown selected address reply %v", reply)
+	}
+	frame["server-identifier"] = "10.0.0.2"
+	if reply := engine.Handle(frame); reply != nil {
+		t.Errorf("request for another server answered with %v", reply)
+	}
+
+	// the receiving interface address is used by default
+	engine.server = ""
+	if reply := engine.Handle(FRAME{"dhcp-message-type": "inform", "source-address": "10.0.0.3", "client-hardware-address": "00:11:22:33:44:77"}); j.String(reply["server-identifier"]) != "10.0.0.3" {
+		t.Errorf("inform reply %v", reply)
+	}
+}
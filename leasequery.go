@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+	"github.com/pyke369/golang-support/ulog"
+)
+
+const LEASEQUERY_TIMEOUT = 2 * time.Minute
+
+// RFC 6926 dhcp-state values
+const (
+	LEASEQUERY_ACTIVE    = 2
+	LEASEQUERY_ABANDONED = 5
+)
+
+// RFC 6926 status-code values
+const (
+	LEASEQUERY_MALFORMED  = 3
+	LEASEQUERY_NOTALLOWED = 4
+)
+
+// relay agent sub-options are looked up in the raw (hex-encoded) relay-agent-information option
+func v4agent(value string, code byte) string {
+	data, err := hex.DecodeString(value)
+	if err != nil {
+		return ""
+	}
+	for offset := 0; offset+2 <= len(data) && offset+2+int(data[offset+1]) <= len(data); offset += 2 + int(data[offset+1]) {
+		if data[offset] == code {
+			return hex.EncodeToString(data[offset+2 : offset+2+int(data[offset+1])])
+		}
+	}
+
+	return ""
+}
+
+func v4status(code int, message string) string {
+	return string([]byte{byte(code)}) + message
+}
+
+// bulk leasequery (RFC 6926) by address, client identifier, hardware address, relay-id, remote-id or for all leases,
+// optionally restricted to leases updated between query-start-time and query-end-time
+func (e *ENGINE) Bulk(frame FRAME) (replies []FRAME) {
+	e.mu.Lock()
+	replies = e.bulk(frame)
+	e.mu.Unlock()
+
+	return
+}
+
+func (e *ENGINE) bulk(frame FRAME) (replies []FRAME) {
+	now, start, end := time.Now().Unix(), int64(j.Number(frame["query-start-time"])), int64(j.Number(frame["query-end-time"]))
+	done := FRAME{"dhcp-message-type": "leasequerydone", "base-time": now}
+	agent, relayid, remoteid := j.String(frame["relay-agent-information"]), "", ""
+	if agent != "" {
+		relayid, remoteid = v4agent(agent, 12), v4agent(agent, 2)
+		if relayid == "" && remoteid == "" {
+			done["status-code"] = v4status(LEASEQUERY_MALFORMED, "missing relay-id or remote-id")
+			return []FRAME{done}
+		}
+	}
+	if end != 0 && end < start {
+		done["status-code"] = v4status(LEASEQUERY_MALFORMED, "invalid query time range")
+		return []FRAME{done}
+	}
+
+	var leases []*LEASE
+	address, byaddress := v4uint(j.String(frame["bootp-client-address"]))
+	client, hardware := j.String(frame["client-identifier"]), strings.ToLower(j.String(frame["client-hardware-address"]))
+	if strings.Trim(hardware, "0:") == "" {
+		hardware = ""
+	}
+	for _, lease := range e.leases {
+		if lease.State != "bound" && lease.State != "declined" {
+			continue
+		}
+		switch {
+		case byaddress:
+			if v4string(address) != lease.Address {
+				continue
+			}
+
+		case client != "":
+			if lease.Client != client {
+				continue
+			}
+
+		case hardware != "":
+			if strings.ToLower(lease.Hardware) != hardware {
+				continue
+			}
+
+		default:
+			if (relayid != "" && v4agent(lease.Agent, 12) != relayid) || (remoteid != "" && v4agent(lease.Agent, 2) != remoteid) {
+				continue
+			}
+		}
+		if (start != 0 && lease.Updated < start) || (end != 0 && lease.Updated > end) {
+			continue
+		}
+		leases = append(leases, lease)
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		first, _ := v4uint(leases[i].Address)
+		second, _ := v4uint(leases[j].Address)
+		return first < second
+	})
+
+	for _, lease := range leases {
+		reply := e.binding(lease, now)
+		reply["dhcp-state"] = LEASEQUERY_ACTIVE
+		if lease.State == "declined" {
+			reply = FRAME{"dhcp-message-type": "leaseunassigned", "bootp-client-address": lease.Address, "dhcp-state": LEASEQUERY_ABANDONED}
+		}
+		reply["base-time"] = now
+		reply["start-time-of-state"] = max(0, now-lease.Updated)
+		if lease.Agent != "" {
+			reply["relay-agent-information"] = lease.Agent
+		}
+		replies = append(replies, reply)
+	}
+
+	return append(replies, done)
+}
+
+// requestors are only accepted from the specified networks (or from the local host if none)
+func requestors(values []string) (networks []*net.IPNet, err error) {
+	if len(values) == 0 {
+		values = []string{"127.0.0.0/8", "::1"}
+	}
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, errors.New("invalid bulk leasequery requestor " + value)
+		}
+		networks = append(networks, network)
+	}
+
+	return
+}
+
+func requestor(networks []*net.IPNet, remote net.Addr) bool {
+	if address, ok := remote.(*net.TCPAddr); ok {
+		for _, network := range networks {
+			if network.Contains(address.IP) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// -B <listening address>[,<requestor network>...]
+// messages are exchanged over TCP, each one being prefixed with its length (RFC 6926 section 7.1)
+func bulkleasequery(value string, port int, engine *ENGINE, logger *ulog.ULog) {
+	parts := strings.Split(value, ",")
+	address := strings.TrimSpace(parts[0])
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address += ":" + strconv.Itoa(port)
+	}
+	networks, err := requestors(parts[1:])
+	if err != nil {
+		bail(err.Error())
+	}
+	listener, err := net.Listen("tcp", strings.TrimLeft(address, "*"))
+	if err != nil {
+		bail(err.Error())
+	}
+	logger.Info(map[string]any{"event": "bind", "bind": address, "mode": "leasequery"})
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			continue
+		}
+		if !requestor(networks, conn.RemoteAddr()) {
+			logger.Warn(map[string]any{"event": "leasequery", "remote": conn.RemoteAddr().String(), "reason": "requestor not allowed"})
+			conn.Close()
+			continue
+		}
+
+		go func() {
+			remote, header := conn.RemoteAddr().String(), make([]byte, 2)
+			for {
+				conn.SetReadDeadline(time.Now().Add(LEASEQUERY_TIMEOUT))
+				if _, err := io.ReadFull(conn, header); err != nil {
+					break
+				}
+				packet := make([]byte, binary.BigEndian.Uint16(header))
+				if _, err := io.ReadFull(conn, packet); err != nil {
+					break
+				}
+				frame, err := v4parse(packet)
+				if err != nil {
+					logger.Warn(map[string]any{"event": "leasequery", "remote": remote, "reason": err.Error()})
+					break
+				}
+				txid := j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"])
+
+				replies := []FRAME{{"dhcp-message-type": "leasequerydone", "status-code": v4status(LEASEQUERY_NOTALLOWED, "unsupported message type")}}
+				if j.String(frame["dhcp-message-type"]) == "bulkleasequery" {
+					replies = engine.Bulk(frame)
+				}
+				logger.Info(map[string]any{"event": "leasequery", "type": j.String(frame["dhcp-message-type"]), "txid": txid, "remote": remote, "leases": len(replies) - 1})
+
+				for _, reply := range replies {
+					reply["bootp-transaction-id"] = frame["bootp-transaction-id"]
+					if _, exists := reply["client-hardware-address"]; !exists && reply["dhcp-message-type"] == "leasequerydone" {
+						reply["client-hardware-address"] = frame["client-hardware-address"]
+					}
+					if packet, err := v4build(reply); err == nil {
+						binary.BigEndian.PutUint16(header, uint16(len(packet)))
+						conn.SetWriteDeadline(time.Now().Add(LEASEQUERY_TIMEOUT))
+						if _, err := conn.Write(append(header, packet...)); err != nil {
+							conn.Close()
+							break
+						}
+
+					} else {
+						logger.Warn(map[string]any{"event": "leasequery", "txid": txid, "remote": remote, "reason": err.Error()})
+					}
+				}
+			}
+			conn.Close()
+		}()
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+)
+
+func testleases(t *testing.T) (engine *ENGINE, now int64) {
+	engine, now = testengine(t), time.Now().Unix()
+	for _, lease := range []*LEASE{
+		{Address: "10.0.0.10", Client: "01aabbccddeeff", Hardware: "aa:bb:cc:dd:ee:ff", Agent: "02036162630c0401020304", State: "bound", Updated: now - 100},
+		{Address: "10.0.0.11", Hardware: "11:22:33:44:55:66", State: "bound", Updated: now - 10},
+		{Address: "10.0.0.12", Client: "ff112233445566", Hardware: "11:22:33:44:55:66", State: "bound", Updated: now - 5},
+		{Address: "10.0.0.13", Hardware: "66:55:44:33:22:11", State: "declined", Updated: now},
+	} {
+		address, _ := v4uint(lease.Address)
+		lease.Pool, lease.Expires = "lan", now+3600
+		engine.set(engine.pools[0], address, lease)
+	}
+
+	return
+}
+
+func TestV4agent(t *testing.T) {
+	for _, test := range []struct {
+		value  string
+		code   byte
+		result string
+	}{
+		{"02036162630c0401020304", 2, "616263"},
+		{"02036162630c0401020304", 12, "01020304"},
+		{"02036162630c0401020304", 1, ""},
+		{"020561", 2, ""},
+		{"invalid", 2, ""},
+	} {
+		if result := v4agent(test.value, test.code); result != test.result {
+			t.Errorf("v4agent(%s, %d) = %s", test.value, test.code, result)
+		}
+	}
+}
+
+func TestRequestors(t *testing.T) {
+	networks, err := requestors(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		networks []*net.IPNet
+		remote   string
+		allowed  bool
+	}{
+		{networks, "127.0.0.1", true},
+		{networks, "::1", true},
+		{networks, "192.168.40.1", false},
+	} {
+		if allowed := requestor(test.networks, &net.TCPAddr{IP: net.ParseIP(test.remote)}); allowed != test.allowed {
+			t.Errorf("requestor(%s) = %t", test.remote, allowed)
+		}
+	}
+
+	networks, err = requestors([]string{"192.168.40.0/24", " 10.0.0.1", "fd00::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for remote, allowed := range map[string]bool{"192.168.40.1": true, "10.0.0.1": true, "10.0.0.2": false, "fd00::1": true, "127.0.0.1": false} {
+		if requestor(networks, &net.TCPAddr{IP: net.ParseIP(remote)}) != allowed {
+			t.Errorf("requestor(%s) != %t", remote, allowed)
+		}
+	}
+	if requestor(networks, &net.UDPAddr{IP: net.ParseIP("192.168.40.1")}) {
+		t.Errorf("non-TCP requestor allowed")
+	}
+	if _, err := requestors([]string{"192.168.40.0/33"}); err == nil {
+		t.Errorf("invalid network accepted")
+	}
+}
+
+func TestEngineQuery(t *testing.T) {
+	engine, _ := testleases(t)
+	for _, test := range []struct {
+		frame      FRAME
+		kind       string
+		address    string
+		associated int
+	}{
+		{FRAME{"bootp-client-address": "10.0.0.10"}, "", "", 0},
+		{FRAME{"bootp-relay-address": "10.0.0.1", "bootp-client-address": "10.0.0.10"}, "leaseactive", "10.0.0.10", 0},
+		{FRAME{"bootp-relay-address": "10.0.0.1", "bootp-client-address": "10.0.0.13"}, "leaseunassigned", "10.0.0.13", 0},
+		{FRAME{"bootp-relay-address": "10.0.0.1", "bootp-client-address": "10.0.0.15"}, "leaseunassigned", "10.0.0.15", 0},
+		{FRAME{"bootp-relay-address": "10.0.0.1", "bootp-client-address": "192.168.0.1"}, "leaseunknown", "192.168.0.1", 0},
+		{FRAME{"bootp-relay-address": "10.0.0.1", "client-identifier": "01aabbccddeeff"}, "leaseactive", "10.0.0.10", 0},
+		{FRAME{"bootp-relay-address": "10.0.0.1", "client-identifier": "01ffffffffffff"}, "leaseunknown", "", 0},
+		{FRAME{"bootp-relay-address": "10.0.0.1", "client-hardware-address": "AA:BB:CC:DD:EE:FF"}, "leaseactive", "10.0.0.10", 0},
+		{FRAME{"bootp-relay-address": "10.0.0.1", "client-hardware-address": "11:22:33:44:55:66"}, "leaseactive", "10.0.0.12", 2},
+		{FRAME{"bootp-relay-address": "10.0.0.1", "client-hardware-address": "66:55:44:33:22:11"}, "leaseunknown", "", 0},
+	} {
+		reply := engine.Query(test.frame)
+		if test.kind == "" {
+			if reply != nil {
+				t.Errorf("Query(%v) = %v", test.frame, reply)
+			}
+			continue
+		}
+		if j.String(reply["dhcp-message-type"]) != test.kind || j.String(reply["bootp-client-address"]) != test.address ||
+			len(j.Slice(reply["associated-addresses"])) != test.associated {
+			t.Errorf("Query(%v) = %v", test.frame, reply)
+		}
+	}
+}
+
+func TestEngineBulk(t *testing.T) {
+	engine, now := testleases(t)
+	for _, test := range []struct {
+		frame     FRAME
+		addresses string
+		status    int
+	}{
+		{FRAME{}, "10.0.0.10 10.0.0.11 10.0.0.12 10.0.0.13", 0},
+		{FRAME{"client-hardware-address": "00:00:00:00:00:00"}, "10.0.0.10 10.0.0.11 10.0.0.12 10.0.0.13", 0},
+		{FRAME{"bootp-client-address": "10.0.0.11"}, "10.0.0.11", 0},
+		{FRAME{"client-identifier": "01aabbccddeeff"}, "10.0.0.10", 0},
+		{FRAME{"client-hardware-address": "11:22:33:44:55:66"}, "10.0.0.11 10.0.0.12", 0},
+		{FRAME{"relay-agent-information": "0c0401020304"}, "10.0.0.10", 0},
+		{FRAME{"relay-agent-information": "0203616263"}, "10.0.0.10", 0},
+		{FRAME{"relay-agent-information": "0203616264"}, "", 0},
+		{FRAME{"relay-agent-information": "0104aabbccdd"}, "", LEASEQUERY_MALFORMED},
+		{FRAME{"query-start-time": now - 50}, "10.0.0.11 10.0.0.12 10.0.0.13", 0},
+		{FRAME{"query-end-time": now - 50}, "10.0.0.10", 0},
+		{FRAME{"client-hardware-address": "11:22:33:44:55:66", "query-start-time": now - 7}, "10.0.0.12", 0},
+		{FRAME{"client-identifier": "01aabbccddeeff", "query-start-time": now - 50}, "", 0},
+		{FRAME{"query-start-time": now, "query-end-time": now - 100}, "", LEASEQUERY_MALFORMED},
+	} {
+		replies := engine.Bulk(test.frame)
+		done, addresses := replies[len(replies)-1], []string{}
+		for _, reply := range replies[:len(replies)-1] {
+			addresses = append(addresses, j.String(reply["bootp-client-address"]))
+		}
+		status := 0
+		if value := j.String(done["status-code"]); value != "" {
+			status = int(value[0])
+		}
+		if j.String(done["dhcp-message-type"]) != "leasequerydone" || strings.Join(addresses, " ") != test.addresses || status != test.status {
+			t.Errorf("Bulk(%v) = %v", test.frame, replies)
+		}
+	}
+
+	// declined leases are reported as abandoned
+	replies := engine.Bulk(FRAME{"bootp-client-address": "10.0.0.13"})
+	if j.String(replies[0]["dhcp-message-type"]) != "leaseunassigned" || j.Number(replies[0]["dhcp-state"]) != LEASEQUERY_ABANDONED {
+		t.Errorf("declined lease = %v", replies[0])
+	}
+}
@@ -14,20 +14,22 @@ import (
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/pyke369/golang-support/chash"
 	"github.com/pyke369/golang-support/fqdn"
 	j "github.com/pyke369/golang-support/jsonrpc"
 	"github.com/pyke369/golang-support/multiflag"
 	"github.com/pyke369/golang-support/uhash"
 	"github.com/pyke369/golang-support/ulog"
 	"github.com/pyke369/golang-support/ustr"
+	"github.com/pyke369/golang-support/uuid"
 	"golang.org/x/sys/unix"
 )
 
@@ -37,20 +39,39 @@ const PROGVER = "2.3.0"
 type SOURCE struct {
 	rconn *Conn
 	pconn net.PacketConn
+	vlan  int
 }
 
 type PACKET struct {
 	source   string
 	hardware string
 	client   string
+	received time.Time
+	key      string
+	keep     bool
 	data     []byte
 }
 
 type CONTEXT struct {
-	created time.Time
-	source  string
-	client  string
-	data    FRAME
+	created  time.Time
+	deadline time.Time
+	source   string
+	client   string
+	data     FRAME
+	meta     map[string]any
+	lease    FRAME
+	nonce    string
+	keep     bool
+}
+
+type ENVELOPE struct {
+	ID       string         `json:"id,omitempty"`
+	Deadline int64          `json:"deadline,omitempty"`
+	Meta     map[string]any `json:"meta,omitempty"`
+	Frame    FRAME          `json:"frame"`
+	Frames   []FRAME        `json:"frames,omitempty"`
+	Action   string         `json:"action,omitempty"`
+	Lifetime int            `json:"lifetime,omitempty"`
 }
 
 func bail(message string, extra ...int) {
@@ -66,6 +87,41 @@ func bail(message string, extra ...int) {
 	os.Exit(0)
 }
 
+func unwrap(payload []byte) (reply *ENVELOPE, err error) {
+	reply = &ENVELOPE{}
+
+	// replies may either be bare frames or envelopes (possibly without any frame, to acknowledge
+	// a request the backend won't answer or extend its context lifetime)
+	if err = json.Unmarshal(payload, reply); err == nil &&
+		reply.ID == "" && reply.Frame == nil && reply.Frames == nil && reply.Action == "" && reply.Lifetime == 0 {
+		err = json.Unmarshal(payload, &reply.Frame)
+	}
+
+	return
+}
+
+func tlsconfig(insecure bool, cacert, cert string) (config *tls.Config) {
+	config = &tls.Config{InsecureSkipVerify: insecure}
+	if path := strings.TrimSpace(cacert); path != "" {
+		if content, err := os.ReadFile(path); err == nil {
+			if der, _ := pem.Decode(content); der != nil && der.Type == "CERTIFICATE" {
+				if cert, err := x509.ParseCertificate(der.Bytes); err == nil && cert.IsCA {
+					pool := x509.NewCertPool()
+					pool.AddCert(cert)
+					config.RootCAs = pool
+				}
+			}
+		}
+	}
+	if parts := strings.Split(cert, ","); len(parts) == 2 {
+		if cert, err := tls.LoadX509KeyPair(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])); err == nil {
+			config.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	return
+}
+
 func main() {
 	var flags flag.FlagSet
 
@@ -80,7 +136,10 @@ func main() {
 	v6 := flags.Bool("6", j.Boolean(os.Getenv("PDHCP_V6")), "run in IPv6 mode")
 	interfaces := flags.String("i", os.Getenv("PDHCP_INTERFACES"), "use specified interface(s)")
 	backend := flags.String("b", os.Getenv("PDHCP_BACKEND"), "set backend command/url")
-	workers := flags.Int("w", int(j.Number(os.Getenv("PDHCP_WORKERS"), 1)), "set workers count (local backend)")
+	workers := flags.Int("w", int(j.Number(os.Getenv("PDHCP_WORKERS"), 1)), "set workers count (local, unix or script backend)")
+	affinity := flags.Bool("A", j.Boolean(os.Getenv("PDHCP_AFFINITY")), "dispatch requests to workers by client identifier (local or unix backend)")
+	envelope := flags.Bool("E", j.Boolean(os.Getenv("PDHCP_ENVELOPE")), "wrap requests with id, deadline and metadata (server mode, required for request ids and workers deadlines)")
+	node := flags.String("N", os.Getenv("PDHCP_NODE"), "set node name (server mode)")
 	relay := flags.String("r", os.Getenv("PDHCP_RELAY"), "set remote DHCP server address (relay mode)")
 	arelay := flags.String("s", os.Getenv("PDHCP_RELAY_ADDRESS"), "use specified alternate relay local address (relay mode)")
 	extra := flags.String("R", os.Getenv("PDHCP_BACKEND"), "overload default options (client mode)")
@@ -94,6 +153,23 @@ func main() {
 	cert := flags.String("c", os.Getenv("PDHCP_CERT"), "use client certificate (remote backend)")
 	cacert := flags.String("C", os.Getenv("PDHCP_CACERT"), "use CA certificate (remote backend)")
 	timeout := flags.Int("t", int(j.Number(os.Getenv("PDHCP_PORT"), 7)), "set backend timeout")
+	qsize := flags.Int("q", int(j.Number(os.Getenv("PDHCP_QUEUE"), 1024)), "set requests queue size (server mode)")
+	admin := flags.String("S", os.Getenv("PDHCP_ADMIN"), "set statistics listening address (server mode)")
+	pools := flags.String("L", os.Getenv("PDHCP_POOLS"), "use native leases engine with specified pools configuration (server mode)")
+	failover := flags.String("F", os.Getenv("PDHCP_FAILOVER"), "set failover role, local and partner addresses (native leases engine)")
+	secret := flags.String("K", os.Getenv("PDHCP_FAILOVER_SECRET"), "set failover shared secret (native leases engine)")
+	bulk := flags.String("B", os.Getenv("PDHCP_BULK"), "set bulk leasequery TCP listening address and allowed requestors (native leases engine)")
+	daemon := flags.Bool("D", j.Boolean(os.Getenv("PDHCP_DAEMON")), "run DHCP client state machine (client mode)")
+	configure := flags.Bool("n", j.Boolean(os.Getenv("PDHCP_CONFIGURE")), "configure interface with obtained leases (client daemon mode)")
+	script := flags.String("x", os.Getenv("PDHCP_SCRIPT"), "run hook script on client events (client daemon mode)")
+	leases := flags.String("k", os.Getenv("PDHCP_LEASES"), "store client leases in specified directory (client daemon mode)")
+	probes := flags.Int("z", int(j.Number(os.Getenv("PDHCP_PROBES"))), "set ARP probes count before accepting leases (client daemon mode)")
+	wait := flags.Int("Z", int(j.Number(os.Getenv("PDHCP_PROBES_WAIT"), 1000)), "set ARP probes wait in milliseconds (client daemon mode)")
+	collect := flags.Bool("O", j.Boolean(os.Getenv("PDHCP_OFFERS")), "collect and show all offers until deadline (client mode)")
+	selection := flags.String("y", os.Getenv("PDHCP_POLICY"), "select offer by policy before requesting it (client mode)")
+	retransmissions := flags.Int("e", int(j.Number(os.Getenv("PDHCP_RETRANSMISSIONS"), 4)), "set requests retransmissions count (client mode)")
+	limit := flags.Int("T", int(j.Number(os.Getenv("PDHCP_DEADLINE"))), "set requests deadline in seconds (client mode, 12 by default in one-shot mode without -e)")
+	output := flags.String("o", j.String(os.Getenv("PDHCP_OUTPUT"), "json"), "use alternate response output format (json, env, networkd or yaml) (client mode)")
 	for _, env := range os.Environ() {
 		if strings.HasPrefix(env, "PDHCP_") {
 			os.Setenv(env, "")
@@ -105,10 +181,17 @@ func main() {
 
 	*timeout = min(30, max(3, *timeout))
 	*workers = min(32, max(1, *workers))
+	*qsize = min(64<<10, max(16, *qsize))
+	if *node == "" {
+		*node, _ = fqdn.FQDN()
+	}
 
 	mode := "client"
-	if *backend != "" {
+	if *backend != "" || *pools != "" {
 		mode = "server"
+		if strings.HasPrefix(*backend, "grpc") {
+			*envelope = true
+		}
 
 	} else if *relay != "" {
 		mode = "relay"
@@ -134,8 +217,8 @@ func main() {
 	}
 	logger := ulog.New(*format)
 	logger.SetOrder([]string{
-		"event", "bind", "mode", "version", "pid", "txid", "type", "local", "worker", "remote",
-		"interface", "client", "address", "hostname", "duration", "relay", "reason", "status",
+		"event", "bind", "mode", "version", "pid", "txid", "type", "local", "worker", "remote", "queue",
+		"interface", "client", "address", "hostname", "state", "pool", "leases", "duration", "relay", "reason", "status",
 	})
 	if mode != "client" {
 		logger.Info(map[string]any{"event": "start", "mode": mode, "version": PROGVER, "pid": os.Getpid()})
@@ -143,13 +226,211 @@ func main() {
 
 	var mu sync.RWMutex
 
-	packets, frames, sources, contexts := make(chan PACKET, 1024), make(chan FRAME, 1024), map[string]*SOURCE{}, map[string]*CONTEXT{}
+	packets, sources, contexts, ids := make(chan PACKET, 1024), map[string]*SOURCE{}, map[string]*CONTEXT{}, map[string]string{}
+	release := func(frame FRAME) {
+		mu.Lock()
+		delete(contexts, v4key(frame))
+		mu.Unlock()
+	}
+	wrap := func(frame FRAME) any {
+		if !*envelope {
+			return frame
+		}
+		key := v4key(frame)
+		request := &ENVELOPE{ID: uuid.New().String(), Deadline: time.Now().Add(time.Duration(*timeout) * time.Second).UnixMilli(), Frame: frame}
+		mu.Lock()
+		if ctx := contexts[key]; ctx != nil {
+			request.Meta = ctx.meta
+			ids[request.ID] = key
+		}
+		mu.Unlock()
+
+		return request
+	}
+	dispatch := func(reply *ENVELOPE, key, source, client string, fields map[string]any) {
+		mu.Lock()
+		ctx := contexts[key]
+		if ctx != nil && reply.Lifetime > 0 {
+			ctx.deadline, ctx.keep = time.Now().Add(time.Duration(min(3600, reply.Lifetime))*time.Second), true
+		}
+		mu.Unlock()
+		if ctx == nil {
+			return
+		}
+
+		frames := reply.Frames
+		if reply.Frame != nil {
+			frames = append([]FRAME{reply.Frame}, frames...)
+		}
+		switch reply.Action {
+		case "":
+
+		case "nak":
+			frame := reply.Frame
+			if frame == nil {
+				frame = FRAME{}
+			}
+			frame["dhcp-message-type"] = "nak"
+			frames = []FRAME{frame}
+
+		case "drop":
+			log := map[string]any{
+				"event":  "drop",
+				"type":   j.String(ctx.data["dhcp-message-type"]),
+				"txid":   j.String(ctx.data["client-hardware-address"]) + "/" + j.String(ctx.data["bootp-transaction-id"]),
+				"reason": "backend action " + reply.Action,
+			}
+			for name, value := range fields {
+				log[name] = value
+			}
+			logger.Info(log)
+			release(ctx.data)
+			return
+
+		default:
+			logger.Warn(map[string]any{
+				"event":  "recv",
+				"type":   j.String(ctx.data["dhcp-message-type"]),
+				"txid":   j.String(ctx.data["client-hardware-address"]) + "/" + j.String(ctx.data["bootp-transaction-id"]),
+				"reason": "invalid backend action " + reply.Action,
+			})
+			return
+		}
+
+		for index, frame := range frames {
+			// backends consulted for options cannot override the leases engine decisions (naks carrying no lease at all)
+			if msgtype := j.String(frame["dhcp-message-type"]); msgtype == "" || msgtype == "offer" || msgtype == "ack" {
+				for name, value := range ctx.lease {
+					if _, exists := frame[name]; !exists || slices.Contains(LEASE_FIELDS, name) {
+						frame[name] = value
+					}
+				}
+			}
+			for _, name := range []string{"client-hardware-address", "bootp-transaction-id"} {
+				if _, exists := frame[name]; !exists {
+					frame[name] = ctx.data[name]
+				}
+			}
+			if packet, err := v4build(frame); err == nil {
+				log := map[string]any{
+					"event": "recv",
+					"type":  j.String(frame["dhcp-message-type"]),
+					"txid":  j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"]),
+				}
+				for name, value := range fields {
+					log[name] = value
+				}
+				logger.Info(log)
+				packets <- PACKET{source: source, client: client, key: key, keep: index < len(frames)-1, data: packet}
+
+			} else {
+				logger.Warn(map[string]any{
+					"event":  "recv",
+					"type":   j.String(frame["dhcp-message-type"]),
+					"txid":   j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"]),
+					"reason": err.Error(),
+				})
+			}
+		}
+	}
+	inject := func(reply *ENVELOPE) string {
+		frame := reply.Frame
+		if frame == nil && len(reply.Frames) > 0 {
+			frame = reply.Frames[0]
+		}
+		address := net.ParseIP(j.String(reply.Meta["address"]))
+		if frame == nil || address == nil || j.String(frame["client-hardware-address"]) == "" {
+			return ""
+		}
+		source, port := j.String(reply.Meta["interface"], "-"), int(j.Number(reply.Meta["port"], float64(*port+1)))
+		mu.Lock()
+		if sources[source] == nil {
+			mu.Unlock()
+			return ""
+		}
+		now, key := time.Now(), "push"+uuid.New().String()
+		contexts[key] = &CONTEXT{
+			created:  now,
+			deadline: now.Add(time.Duration(max(10, *timeout)) * time.Second),
+			source:   source,
+			client:   net.JoinHostPort(address.String(), strconv.Itoa(port)),
+			data: FRAME{
+				"client-hardware-address": frame["client-hardware-address"],
+				"bootp-transaction-id":    j.String(frame["bootp-transaction-id"], ustr.HexInt(uint64(uhash.Rand(1<<32-1)), 4)),
+			},
+		}
+		mu.Unlock()
+
+		return key
+	}
+	handle := func(reply *ENVELOPE, source, client string, fields map[string]any) {
+		key := ""
+		if reply.ID != "" {
+			mu.RLock()
+			key = ids[reply.ID]
+			mu.RUnlock()
+
+		} else if reply.Meta != nil {
+			// unsolicited frames pushed by the backend, sent to the client address specified in metadata
+			key = inject(reply)
+
+		} else if reply.Frame != nil {
+			key = v4key(reply.Frame)
+		}
+		if key != "" {
+			dispatch(reply, key, source, client, fields)
+		}
+	}
+	requests, queues := NewQueue("requests", *qsize, logger, release), []*QUEUE{}
+	frames := requests.output
+	var (
+		engine  *ENGINE
+		partner *FAILOVER
+	)
 	if mode == "server" {
-		if strings.HasPrefix(*backend, "http") {
+		if *pools != "" {
+			var err error
+			if engine, err = NewEngine(*pools, logger); err != nil {
+				bail(err.Error())
+			}
+			if value := net.ParseIP(*address).To4(); value != nil {
+				engine.server = value.String()
+			}
+		}
+		if *failover != "" {
+			var err error
+			if engine == nil {
+				bail("failover requires the native leases engine")
+			}
+			if partner, err = NewFailover(*failover, *secret, *node, engine, logger); err != nil {
+				bail(err.Error())
+			}
+			partner.Run()
+		}
+		if *bulk != "" {
+			if engine == nil {
+				bail("bulk leasequery requires the native leases engine")
+			}
+			go bulkleasequery(*bulk, *port, engine, logger)
+		}
+
+		if *backend == "" {
+			// requests are only handled by the native leases engine
+
+		} else if strings.HasPrefix(*backend, "grpc") {
+			go grpcbackend(*backend, tlsconfig(*insecure, *cacert, *cert), requests, wrap, handle, logger)
+
+		} else if strings.HasPrefix(*backend, "file://") {
+			go filebackend(*backend, requests, dispatch, release, logger)
+
+		} else if strings.HasPrefix(*backend, "script://") {
+			scriptbackend(*backend, *workers, *timeout, requests, dispatch, release, logger)
+
+		} else if strings.HasPrefix(*backend, "http") {
 			go func() {
 				for {
 					go func(frame FRAME) {
-						if payload, err := json.Marshal(frame); err == nil {
+						if payload, err := json.Marshal(wrap(frame)); err == nil {
 							if request, err := http.NewRequest(http.MethodPost, *backend, bytes.NewBuffer(payload)); err == nil {
 								request.Header.Set("Content-Length", strconv.Itoa(len(payload)))
 								request.Header.Set("Content-Type", "application/json")
@@ -167,26 +448,7 @@ func main() {
 									"remote": remote.String(),
 								})
 
-								transport := &http.Transport{TLSClientConfig: &tls.Config{
-									InsecureSkipVerify: *insecure,
-								}}
-								if path := strings.TrimSpace(*cacert); path != "" {
-									if content, err := os.ReadFile(path); err == nil {
-										if der, _ := pem.Decode(content); der != nil && der.Type == "CERTIFICATE" {
-											if cert, err := x509.ParseCertificate(der.Bytes); err == nil && cert.IsCA {
-												pool := x509.NewCertPool()
-												pool.AddCert(cert)
-												transport.TLSClientConfig.RootCAs = pool
-											}
-										}
-									}
-								}
-								if parts := strings.Split(*cert, ","); len(parts) == 2 {
-									if cert, err := tls.LoadX509KeyPair(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])); err == nil {
-										transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
-									}
-								}
-
+								transport := &http.Transport{TLSClientConfig: tlsconfig(*insecure, *cacert, *cert)}
 								client := &http.Client{
 									Timeout:   time.Duration(*timeout) * time.Second,
 									Transport: transport,
@@ -195,21 +457,8 @@ func main() {
 									payload, _ := io.ReadAll(response.Body)
 									response.Body.Close()
 
-									frame := FRAME{}
-									if err := json.Unmarshal(payload, &frame); err == nil {
-										mu.RLock()
-										if contexts[v4key(frame)] != nil {
-											if packet, err := v4build(frame); err == nil {
-												logger.Info(map[string]any{
-													"event":  "recv",
-													"type":   j.String(frame["dhcp-message-type"]),
-													"txid":   j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"]),
-													"remote": remote.String(),
-												})
-												packets <- PACKET{source: "http", client: *backend, data: packet}
-											}
-										}
-										mu.RUnlock()
+									if reply, err := unwrap(payload); err == nil {
+										dispatch(reply, v4key(frame), "http", *backend, map[string]any{"remote": remote.String()})
 									}
 
 								} else {
@@ -228,196 +477,437 @@ func main() {
 			}()
 
 		} else {
-			for *workers > 0 {
+			// requests from a given client are always handled by the same worker in affinity mode,
+			// and redistributed to the remaining workers while its process is being restarted
+			ring, inputs := chash.New(), make([]chan FRAME, *workers)
+			for index := range inputs {
+				inputs[index] = frames
+			}
+			if *affinity {
+				for index := range inputs {
+					queues = append(queues, NewQueue("worker"+strconv.Itoa(index), *qsize, logger, release))
+					inputs[index] = queues[index].output
+				}
 				go func() {
 					for {
-						parts := strings.Split(*backend, " ")
-						if path, err := exec.LookPath(parts[0]); err == nil {
-							parts[0] = filepath.Base(parts[0])
-							cmd, pid := &exec.Cmd{Path: path, Args: parts, Stderr: os.Stderr}, 0
-							if stdin, err := cmd.StdinPipe(); err == nil {
-								if stdout, err := cmd.StdoutPipe(); err == nil {
-									if err := cmd.Start(); err == nil {
-										pid = cmd.Process.Pid
-										logger.Info(map[string]any{
-											"event":  "start",
-											"local":  cmd.Path,
-											"worker": pid,
-										})
-										queue := make(chan FRAME)
-
-										go func() {
-											reader := bufio.NewReader(stdout)
-											for {
-												if line, err := reader.ReadString('\n'); err != nil {
-													queue <- nil
-													break
-
-												} else {
-													var frame FRAME
-
-													if err := json.Unmarshal([]byte(line), &frame); err == nil {
-														mu.RLock()
-														if contexts[v4key(frame)] != nil {
-															queue <- frame
-														}
-														mu.RUnlock()
-
-													} else {
-														cmd.Process.Kill()
-													}
-												}
-											}
-										}()
-
-									loop:
-										for {
-											select {
-											case frame := <-frames:
-												if payload, err := json.Marshal(frame); err == nil {
-													payload = append(payload, '\n')
-													if _, err := stdin.Write(payload); err == nil {
-														logger.Info(map[string]any{
-															"event":  "send",
-															"type":   j.String(frame["dhcp-message-type"]),
-															"txid":   j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"]),
-															"local":  cmd.Path,
-															"worker": pid,
-														})
-													}
-												}
-
-											case frame := <-queue:
-												if frame == nil {
-													break loop
-												}
-												if packet, err := v4build(frame); err == nil {
-													logger.Info(map[string]any{
-														"event":  "recv",
-														"type":   j.String(frame["dhcp-message-type"]),
-														"txid":   j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"]),
-														"local":  cmd.Path,
-														"worker": pid,
-													})
-													packets <- PACKET{source: "worker", client: strconv.Itoa(pid), data: packet}
-												}
-											}
+						frame := <-frames
+						if index := affine(ring, frame); index >= 0 {
+							queues[index].Push(frame)
+
+						} else {
+							requests.Drop(frame, "no worker")
+							release(frame)
+						}
+					}
+				}()
+			}
+
+			for index := range *workers {
+				go func(index int) {
+					backoff := time.Second
+					for {
+						var (
+							worker *WORKER
+							err    error
+						)
+
+						socket := strings.HasPrefix(*backend, "unix://")
+						if socket {
+							worker, err = connect(*backend)
+
+						} else {
+							worker, err = spawn(*backend)
+						}
+						if err == nil {
+							backoff = time.Second
+							logger.Info(map[string]any{
+								"event":  "start",
+								"local":  worker.name,
+								"worker": worker.pid,
+							})
+							if *affinity {
+								ring.AddTarget(strconv.Itoa(index), 1)
+							}
+							queue := make(chan *ENVELOPE)
+
+							go func() {
+								reader := bufio.NewReader(worker.output)
+								for {
+									if line, err := reader.ReadString('\n'); err != nil {
+										queue <- nil
+										break
+
+									} else {
+										if reply, err := unwrap([]byte(line)); err == nil {
+											queue <- reply
+
+										} else {
+											worker.kill()
+										}
+									}
+								}
+							}()
+
+							pending, misses, ticker := map[string]*ENVELOPE{}, 0, time.NewTicker(time.Second)
+						loop:
+							for {
+								select {
+								case frame := <-inputs[index]:
+									request := wrap(frame)
+									if value, ok := request.(*ENVELOPE); ok {
+										pending[value.ID] = value
+									}
+									if payload, err := json.Marshal(request); err == nil {
+										payload = append(payload, '\n')
+										if _, err := worker.input.Write(payload); err == nil {
+											logger.Info(map[string]any{
+												"event":  "send",
+												"type":   j.String(frame["dhcp-message-type"]),
+												"txid":   j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"]),
+												"local":  worker.name,
+												"worker": worker.pid,
+											})
+										}
+									}
+
+								case now := <-ticker.C:
+									for id, request := range pending {
+										if now.UnixMilli() >= request.Deadline {
+											delete(pending, id)
+											release(request.Frame)
+											misses++
+											logger.Warn(map[string]any{
+												"event":  "timeout",
+												"type":   j.String(request.Frame["dhcp-message-type"]),
+												"txid":   j.String(request.Frame["client-hardware-address"]) + "/" + j.String(request.Frame["bootp-transaction-id"]),
+												"local":  worker.name,
+												"worker": worker.pid,
+											})
 										}
 									}
+									if misses >= 3 {
+										logger.Warn(map[string]any{
+											"event":  "stop",
+											"local":  worker.name,
+											"worker": worker.pid,
+											"reason": strconv.Itoa(misses) + " missed deadlines",
+										})
+										worker.kill()
+										misses = 0
+									}
+
+								case reply := <-queue:
+									if reply == nil {
+										break loop
+									}
+									if pending[reply.ID] != nil {
+										delete(pending, reply.ID)
+										misses = 0
+									}
+									handle(reply, "worker", strconv.Itoa(worker.pid), map[string]any{"local": worker.name, "worker": worker.pid})
 								}
 							}
-							err, status := cmd.Wait(), "normal exit"
+							ticker.Stop()
+							if *affinity {
+								ring.RemoveTarget(strconv.Itoa(index))
+								for _, frame := range queues[index].Drain() {
+									requests.Push(frame)
+								}
+							}
+							err, status := worker.wait(), "normal exit"
 							if err != nil {
 								status = err.Error()
 							}
 							logger.Warn(map[string]any{
 								"event":  "stop",
-								"local":  cmd.Path,
-								"worker": pid,
+								"local":  worker.name,
+								"worker": worker.pid,
 								"status": status,
 							})
+
+						} else {
+							logger.Warn(map[string]any{
+								"event":  "start",
+								"local":  *backend,
+								"reason": err.Error(),
+							})
+						}
+
+						// local workers are restarted after a fixed delay, while sockets are reconnected with exponential backoff
+						if socket {
+							time.Sleep(backoff)
+							backoff = min(30*time.Second, backoff*2)
+
+						} else {
+							time.Sleep(3 * time.Second)
 						}
-						time.Sleep(3 * time.Second)
 					}
-				}()
-				*workers--
+				}(index)
 			}
 		}
+
+		if *admin != "" {
+			mux := http.NewServeMux()
+			mux.HandleFunc("/stats", func(response http.ResponseWriter, request *http.Request) {
+				if request.Method != http.MethodGet {
+					response.WriteHeader(http.StatusMethodNotAllowed)
+					return
+				}
+				stats := map[string]any{"queues": []any{requests.Stats()}}
+				if engine != nil {
+					stats["pools"] = engine.Stats()
+				}
+				if partner != nil {
+					stats["failover"] = partner.State()
+				}
+				for _, queue := range queues {
+					stats["queues"] = append(stats["queues"].([]any), queue.Stats())
+				}
+				mu.RLock()
+				stats["contexts"] = len(contexts)
+				mu.RUnlock()
+				if content, err := json.Marshal(stats); err == nil {
+					response.Header().Set("Content-Type", "application/json")
+					response.Write(append(content, '\n'))
+
+				} else {
+					response.WriteHeader(http.StatusInternalServerError)
+				}
+			})
+			if engine != nil {
+				// server-initiated lease renewal (RFC 3203), only sent to clients supporting its authentication (RFC 6704)
+				// and only triggered from the local host
+				mux.HandleFunc("/forcerenew", func(response http.ResponseWriter, request *http.Request) {
+					if request.Method != http.MethodPost {
+						response.WriteHeader(http.StatusMethodNotAllowed)
+						return
+					}
+					if host, _, err := net.SplitHostPort(request.RemoteAddr); err != nil || !net.ParseIP(host).IsLoopback() {
+						response.WriteHeader(http.StatusForbidden)
+						return
+					}
+					lease := engine.Find(request.URL.Query().Get("client"))
+					if lease == nil {
+						http.Error(response, "unknown lease", http.StatusNotFound)
+						return
+					}
+					if lease.Nonce == "" {
+						http.Error(response, "client does not support forcerenew authentication", http.StatusConflict)
+						return
+					}
+
+					// the message is sent through the client relay, or directly on the interface the client was last seen on
+					source, client := "-", net.JoinHostPort(lease.Relay, strconv.Itoa(*port))
+					data := FRAME{
+						"client-hardware-address": lease.Hardware,
+						"bootp-transaction-id":    ustr.HexInt(uint64(uhash.Rand(1<<32-1)), 4),
+					}
+					mu.Lock()
+					if lease.Relay != "" {
+						data["bootp-relay-address"] = lease.Relay
+
+					} else {
+						source, client = "", net.JoinHostPort(lease.Address, strconv.Itoa(*port+1))
+						for name, candidate := range sources {
+							if candidate.rconn != nil && candidate.rconn.Local.Addr != nil && candidate.rconn.Local.Addr.String() == lease.Local {
+								source = name
+								break
+							}
+						}
+					}
+					if source == "" {
+						mu.Unlock()
+						http.Error(response, "unknown client interface", http.StatusConflict)
+						return
+					}
+					now, key := time.Now(), "push"+uuid.New().String()
+					contexts[key] = &CONTEXT{
+						created:  now,
+						deadline: now.Add(time.Duration(max(10, *timeout)) * time.Second),
+						source:   source,
+						client:   client,
+						data:     data,
+						nonce:    lease.Nonce,
+					}
+					mu.Unlock()
+					dispatch(&ENVELOPE{Frame: FRAME{
+						"dhcp-message-type":    "forcerenew",
+						"bootp-client-address": lease.Address,
+						"authentication":       v4auth(2, make([]byte, 16)),
+					}}, key, "admin", request.RemoteAddr, map[string]any{"remote": request.RemoteAddr})
+					if content, err := json.Marshal(map[string]any{"address": lease.Address, "client": lease.Client, "interface": source}); err == nil {
+						response.Header().Set("Content-Type", "application/json")
+						response.Write(append(content, '\n'))
+					}
+				})
+			}
+			go func() {
+				logger.Info(map[string]any{"event": "bind", "bind": *admin, "mode": "admin"})
+				for {
+					if err := http.ListenAndServe(*admin, mux); err != nil {
+						logger.Warn(map[string]any{"event": "bind", "bind": *admin, "mode": "admin", "reason": err.Error()})
+					}
+					time.Sleep(3 * time.Second)
+				}
+			}()
+		}
 	}
 
 	if mode == "client" {
 		if *interfaces == "" {
 			bail("no interface specified")
 		}
+		if !OUTPUT_FORMATS[*output] {
+			bail("unknown output format '" + *output + "'")
+		}
 
 		conn, err := NewConn(&Addr{Port: *port + 1, Device: *interfaces})
 		if err != nil {
 			bail(err.Error())
 		}
-		for try := 3; try <= 5; try++ {
-			txid := uhash.Rand(1<<32 - 1)
-			frame := map[string]any{
-				"bootp-transaction-id":    ustr.HexInt(uint64(txid), 4),
-				"bootp-broadcast":         true,
-				"dhcp-message-type":       "discover",
-				"client-hardware-address": conn.Local.HardwareAddr.String(),
-				"parameters-request-list": []any{"hostname", "subnet-mask", "routers", "domain-name", "domain-name-servers", "domain-search", "classless-route", "time-offset", "ntp-servers"},
+		template := FRAME{
+			"bootp-broadcast":         true,
+			"dhcp-message-type":       "discover",
+			"client-hardware-address": conn.Local.HardwareAddr.String(),
+			"parameters-request-list": []any{"hostname", "subnet-mask", "routers", "domain-name", "domain-name-servers", "domain-search", "classless-route", "time-offset", "ntp-servers"},
+		}
+		if conn.Local.Addr != nil {
+			template["requested-ip-address"] = conn.Local.Addr.String()
+		}
+		hostname, _ := fqdn.FQDN()
+		if hostname != "" && hostname != "unknown" {
+			template["hostname"] = hostname
+		}
+		eframe := map[string]any{}
+		if *extra != "" {
+			if err := json.Unmarshal([]byte(*extra), &eframe); err != nil {
+				bail(err.Error())
 			}
-			if conn.Local.Addr != nil {
-				frame["requested-ip-address"] = conn.Local.Addr.String()
+			for name, value := range eframe {
+				template[name] = value
 			}
-			hostname, _ := fqdn.FQDN()
-			if hostname != "" && hostname != "unknown" {
-				frame["hostname"] = hostname
+		}
+		policy, err := Policy(*selection)
+		if err != nil {
+			bail(err.Error())
+		}
+		settings := SETTINGS{
+			Configure: *configure, Script: *script, Leases: *leases, Probes: *probes, Wait: time.Duration(*wait) * time.Millisecond,
+			Policy: policy, Retransmissions: max(0, *retransmissions),
+		}
+		if *daemon {
+			if list, ok := template["parameters-request-list"].([]any); ok && *configure {
+				template["parameters-request-list"] = append(list, "interface-mtu")
 			}
-			if *extra != "" {
-				var eframe map[string]any
 
-				if err := json.Unmarshal([]byte(*extra), &eframe); err != nil {
-					bail(err.Error())
+			// only explicitly requested or stored addresses are verified first (INIT-REBOOT), the interface address being a
+			// mere hint (each exchange being bounded by the deadline, if any)
+			settings.Deadline = time.Duration(max(0, *limit)) * time.Second
+			NewClient(conn, *port, template, settings).Run(j.String(eframe["requested-ip-address"]))
+		}
+
+		// requests (dumped) and responses are shown in JSON form (prefixed when pretty-printed), the latter being possibly
+		// rendered in an alternate output format
+		show := func(value any, label string) {
+			content, err := json.Marshal(value)
+			if frame, ok := value.(FRAME); ok && label == "response" && *output != "json" {
+				content = render(frame, conn.Local.Device, *output)
+
+			} else if *pretty {
+				prefix := "< "
+				if label == "request" {
+					prefix = "> "
 				}
-				for name, value := range eframe {
-					frame[name] = value
+				content, err = json.MarshalIndent(value, "", "  ")
+				content = append([]byte(prefix+label+" "), bytes.ReplaceAll(content, []byte("\n"), []byte("\n"+prefix))...)
+				if label == "request" {
+					content = append(content, '\n')
 				}
 			}
-			from, to := &Addr{}, &Addr{Port: *port}
-			if value := j.String(frame["bootp-client-address"]); value != "" {
-				from.Addr = net.ParseIP(value)
+			if err != nil {
+				bail(err.Error())
+			}
+			os.Stdout.Write(append(content, '\n'))
+		}
+
+		// one-shot requests are bounded by a short deadline by default, unless the retransmissions count is explicitly set
+		// (the whole retransmission schedule being honoured then)
+		explicit := os.Getenv("PDHCP_RETRANSMISSIONS") != ""
+		flags.Visit(func(option *flag.Flag) {
+			if option.Name == "e" {
+				explicit = true
 			}
+		})
+		if *limit <= 0 && !explicit {
+			*limit = 12
+		}
+		client, deadline := NewClient(conn, *port, template, settings), time.Time{}
+		if *limit > 0 {
+			deadline = time.Now().Add(time.Duration(*limit) * time.Second)
+		}
+		frame := FRAME{"bootp-transaction-id": ustr.HexInt(uint64(uhash.Rand(1<<32-1)), 4)}
+		for name, value := range template {
+			frame[name] = value
+		}
+		from, to := &Addr{Addr: net.ParseIP(j.String(frame["bootp-client-address"]))}, &Addr{Port: *port}
+		if *dump {
+			show(frame, "request")
+		}
 
-			if packet, err := v4build(frame); err == nil {
-				if *dump {
-					content, err := json.Marshal(frame)
-					if *pretty {
-						content, err = json.MarshalIndent(frame, "", "  ")
-						content = append([]byte("> request "), bytes.ReplaceAll(content, []byte("\n"), []byte("\n> "))...)
-						content = append(content, '\n')
-					}
-					if err == nil {
-						os.Stdout.Write(append(content, '\n'))
+		// all replies received until the deadline are shown (e.g. offers, to audit responding servers), the offer chosen
+		// according to the selection policy (if any) being requested afterwards
+		if *collect || policy != nil {
+			client.started = time.Now()
+			replies := client.gather(frame, from, to, deadline)
+			if replies == nil {
+				bail("no response from server")
+			}
+			if *collect || policy == nil {
+				show(replies, "responses")
+			}
+
+			if policy != nil {
+				offers := []FRAME{}
+				for _, reply := range replies {
+					if reply["dhcp-message-type"] == "offer" {
+						offers = append(offers, reply)
 					}
 				}
-				if _, err := conn.WriteTo(from, to, packet); err == nil {
-					conn.SetReadDeadline(time.Now().Add(time.Duration(try) * time.Second))
-					packet := make([]byte, 4<<10)
-					for {
-						read, _, err := conn.ReadFrom(packet)
-						if err != nil {
-							break
-						}
-						if rframe, err := v4parse(packet[:read]); err == nil {
-							if rframe["bootp-opcode"] == "reply" &&
-								rframe["client-hardware-address"] == frame["client-hardware-address"] &&
-								rframe["bootp-transaction-id"] == frame["bootp-transaction-id"] {
-								if mrequest, ok := frame["dhcp-message-type"].(string); ok {
-									if mresponse, ok := rframe["dhcp-message-type"].(string); ok {
-										if response := V4MSGTYPES[V4RMSGTYPES[mresponse]]; response != nil &&
-											(response.request == 0 || response.request == V4RMSGTYPES[mrequest]) {
-											content, err := json.Marshal(rframe)
-											if *pretty {
-												content, err = json.MarshalIndent(rframe, "", "  ")
-												content = append([]byte("< response "), bytes.ReplaceAll(content, []byte("\n"), []byte("\n< "))...)
-											}
-											if err == nil {
-												os.Stdout.Write(append(content, '\n'))
-												bail("")
-											}
-											bail(err.Error())
-										}
-									}
-								}
-							}
-						}
-					}
-
-				} else {
-					bail(err.Error())
+				offer := choose(offers, policy, j.String(template["requested-ip-address"]))
+				if offer == nil {
+					bail("no offer from server")
 				}
-
-			} else {
-				bail(err.Error())
+				// the request is sent with the offer transaction id, and keeps counting elapsed time from the discover
+				frame = FRAME{"bootp-transaction-id": offer["bootp-transaction-id"]}
+				for name, value := range template {
+					frame[name] = value
+				}
+				frame["dhcp-message-type"] = "request"
+				frame["requested-ip-address"], frame["server-identifier"] = offer["bootp-assigned-address"], offer["server-identifier"]
+				if *dump {
+					show(frame, "request")
+				}
+				reply, _ := client.exchange(frame, from, to, deadline, "ack", "nak")
+				if reply == nil {
+					bail("no response from server")
+				}
+				show(reply, "response")
 			}
+			bail("")
 		}
+
+		// the first reply matching the request message type is shown
+		mrequest := j.String(frame["dhcp-message-type"])
+		client.transmit(frame, from, to, deadline, func(rframe FRAME, _ *Addr) bool {
+			if mresponse, ok := rframe["dhcp-message-type"].(string); ok {
+				if response := V4MSGTYPES[V4RMSGTYPES[mresponse]]; response != nil &&
+					(response.request == 0 || response.request == V4RMSGTYPES[mrequest]) {
+					show(rframe, "response")
+					bail("")
+				}
+			}
+			return false
+		})
 		bail("no response from server")
 
 	} else {
@@ -429,6 +919,7 @@ func main() {
 			go func(name string) {
 				source := &SOURCE{}
 				if name != "" {
+					source.vlan = Vlan(name)
 					if conn, err := NewConn(&Addr{Port: *port, Device: name}); err == nil {
 						if conn.Local.Addr == nil {
 							logger.Warn(map[string]any{
@@ -519,12 +1010,12 @@ func main() {
 					packet := [4 << 10]byte{}
 					if source.rconn != nil {
 						if read, from, err := source.rconn.ReadFrom(packet[:]); err == nil {
-							packets <- PACKET{source: name, hardware: from.HardwareAddr.String(), client: from.Addr.String() + ":" + strconv.Itoa(from.Port), data: packet[:read]}
+							packets <- PACKET{source: name, hardware: from.HardwareAddr.String(), client: from.Addr.String() + ":" + strconv.Itoa(from.Port), received: time.Now(), data: packet[:read]}
 						}
 
 					} else if source.pconn != nil {
 						if read, from, err := source.pconn.ReadFrom(packet[:]); err == nil {
-							packets <- PACKET{source: name, client: from.String(), data: packet[:read]}
+							packets <- PACKET{source: name, client: from.String(), received: time.Now(), data: packet[:read]}
 						}
 					}
 				}
@@ -536,10 +1027,15 @@ func main() {
 				now := time.Now()
 				mu.Lock()
 				for key, context := range contexts {
-					if now.Sub(context.created) >= 10*time.Second {
+					if now.After(context.deadline) {
 						delete(contexts, key)
 					}
 				}
+				for id, key := range ids {
+					if contexts[key] == nil {
+						delete(ids, id)
+					}
+				}
 				mu.Unlock()
 				time.Sleep(time.Second)
 			}
@@ -552,8 +1048,12 @@ func main() {
 				continue
 			}
 
-			key := v4key(frame)
-			if frame["bootp-opcode"] == "request" {
+			// backend replies are bound to their originating request context, whatever their message type
+			key := packet.key
+			if key == "" {
+				key = v4key(frame)
+			}
+			if packet.key == "" && frame["bootp-opcode"] == "request" {
 				if j.String(frame["bootp-relay-address"]) != "" {
 					if packet.source != "-" {
 						continue
@@ -578,9 +1078,36 @@ func main() {
 				mu.Lock()
 				if contexts[key] != nil {
 					mu.Unlock()
-					break
+					requests.Drop(frame, "retransmit in progress")
+					continue
+				}
+				now := time.Now()
+				contexts[key] = &CONTEXT{
+					created:  now,
+					deadline: now.Add(time.Duration(max(10, *timeout)) * time.Second),
+					source:   packet.source,
+					client:   packet.client,
+					data:     frame,
+				}
+				if *envelope {
+					meta := map[string]any{
+						"interface": packet.source,
+						"relayed":   j.String(frame["bootp-relay-address"]) != "",
+						"received":  packet.received.UnixMilli(),
+						"node":      *node,
+					}
+					if source := sources[packet.source]; source != nil && source.vlan != 0 {
+						meta["vlan"] = source.vlan
+					}
+					if packet.hardware != "" {
+						meta["hardware"] = packet.hardware
+					}
+					if address, value, err := net.SplitHostPort(packet.client); err == nil {
+						port, _ := strconv.Atoi(value)
+						meta["address"], meta["port"] = address, port
+					}
+					contexts[key].meta = meta
 				}
-				contexts[key] = &CONTEXT{time.Now(), packet.source, packet.client, frame}
 				mu.Unlock()
 				logger.Info(map[string]any{
 					"event":     "request",
@@ -619,19 +1146,53 @@ func main() {
 					if sources[packet.source].rconn != nil {
 						frame["source-address"] = sources[packet.source].rconn.Local.Addr.String()
 					}
-					select {
-					case frames <- frame:
 
-					default:
+					// the leases engine answers by itself, unless a backend is to be consulted for options
+					if engine != nil {
+						// leasequeries are answered from the (shared) leases table by both failover partners
+						if j.String(frame["dhcp-message-type"]) == "leasequery" {
+							if reply := engine.Query(frame); reply != nil {
+								go dispatch(&ENVELOPE{Frame: reply}, key, "lease", *pools, map[string]any{"local": *pools})
+
+							} else {
+								release(frame)
+							}
+							continue
+						}
+
+						// requests from clients served by the failover partner are ignored
+						if partner != nil && !partner.Serve(frame) {
+							release(frame)
+							continue
+						}
+						reply := engine.Handle(frame)
+						if reply == nil {
+							release(frame)
+							continue
+						}
+						if *backend == "" || j.String(reply["dhcp-message-type"]) == "nak" {
+							go dispatch(&ENVELOPE{Frame: reply}, key, "lease", *pools, map[string]any{"local": *pools})
+							continue
+						}
+						mu.Lock()
+						if ctx := contexts[key]; ctx != nil {
+							ctx.lease = reply
+						}
+						mu.Unlock()
+						if value := j.String(reply["bootp-assigned-address"]); value != "" {
+							frame["bootp-assigned-address"] = value
+						}
 					}
+					requests.Push(frame)
 				}
 
 			} else {
+				keep := packet.keep
 				mu.RLock()
 				ctx := contexts[key]
 				mu.RUnlock()
 				if ctx == nil {
-					break
+					continue
 				}
 				client := ctx.client
 				if address, port, err := net.SplitHostPort(ctx.client); err == nil {
@@ -645,7 +1206,7 @@ func main() {
 					}
 
 				} else {
-					break
+					continue
 				}
 				if mode == "relay" {
 					logger.Info(map[string]any{
@@ -659,6 +1220,9 @@ func main() {
 					frame["server-identifier"] = sources[ctx.source].rconn.Local.Addr.String()
 				}
 				packet, _ := v4build(frame)
+				if ctx.nonce != "" {
+					v4sign(packet, ctx.nonce)
+				}
 				if sources[ctx.source].rconn != nil {
 					if address, value, err := net.SplitHostPort(client); err == nil {
 						port, _ := strconv.Atoi(value)
@@ -668,24 +1232,24 @@ func main() {
 						}
 						if _, err := sources[ctx.source].rconn.WriteTo(nil, to, packet); err != nil {
 							logger.Warn(map[string]any{"event": "reply", "reason": err.Error()})
-							break
+							continue
 						}
 
 					} else {
 						logger.Warn(map[string]any{"event": "reply", "reason": err.Error()})
-						break
+						continue
 					}
 
 				} else {
 					if address, err := net.ResolveUDPAddr("udp", client); err == nil {
 						if _, err := sources[ctx.source].pconn.WriteTo(packet, address); err != nil {
 							logger.Warn(map[string]any{"event": "reply", "reason": err.Error()})
-							break
+							continue
 						}
 
 					} else {
 						logger.Warn(map[string]any{"event": "reply", "reason": err.Error()})
-						break
+						continue
 					}
 				}
 				hostname := j.String(frame["hostname"])
@@ -703,7 +1267,9 @@ func main() {
 					"duration":  ustr.Duration(time.Since(ctx.created)),
 				})
 				mu.Lock()
-				delete(contexts, key)
+				if !keep && !ctx.keep {
+					delete(contexts, key)
+				}
 				mu.Unlock()
 			}
 		}
@@ -0,0 +1,140 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+func nlattribute(kind uint16, value []byte) []byte {
+	attribute := make([]byte, 4, (4+len(value)+3)&^3)
+	binary.NativeEndian.PutUint16(attribute, uint16(4+len(value)))
+	binary.NativeEndian.PutUint16(attribute[2:], kind)
+	attribute = append(attribute, value...)
+
+	return append(attribute, make([]byte, cap(attribute)-len(attribute))...)
+}
+
+// a single acknowledged rtnetlink request is sent over a transient socket
+func nlrequest(kind, flags uint16, header []byte, attributes ...[]byte) error {
+	handle, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	if err := unix.Bind(handle, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(handle)
+		return err
+	}
+
+	message := make([]byte, unix.NLMSG_HDRLEN, 256)
+	message = append(message, header...)
+	for _, attribute := range attributes {
+		message = append(message, attribute...)
+	}
+	binary.NativeEndian.PutUint32(message, uint32(len(message)))
+	binary.NativeEndian.PutUint16(message[4:], kind)
+	binary.NativeEndian.PutUint16(message[6:], unix.NLM_F_REQUEST|unix.NLM_F_ACK|flags)
+	binary.NativeEndian.PutUint32(message[8:], 1)
+	if err := unix.Sendto(handle, message, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(handle)
+		return err
+	}
+
+	reply := make([]byte, 4<<10)
+	for {
+		read, _, err := unix.Recvfrom(handle, reply, 0)
+		if err != nil {
+			unix.Close(handle)
+			return err
+		}
+		messages, err := syscall.ParseNetlinkMessage(reply[:read])
+		if err != nil {
+			unix.Close(handle)
+			return err
+		}
+		for _, message := range messages {
+			if message.Header.Type == unix.NLMSG_ERROR && len(message.Data) >= 4 {
+				unix.Close(handle)
+				if code := int32(binary.NativeEndian.Uint32(message.Data)); code != 0 {
+					return syscall.Errno(-code)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+func InterfaceAddress(device string, address *net.IPNet, add bool) error {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return err
+	}
+	ip := address.IP.To4()
+	if ip == nil {
+		return errors.New("invalid address " + address.String())
+	}
+	ones, _ := address.Mask.Size()
+	header := make([]byte, unix.SizeofIfAddrmsg)
+	header[0], header[1] = unix.AF_INET, byte(ones)
+	binary.NativeEndian.PutUint32(header[4:], uint32(iface.Index))
+	broadcast := make(net.IP, 4)
+	for index := range broadcast {
+		broadcast[index] = ip[index] | ^address.Mask[len(address.Mask)-4+index]
+	}
+
+	kind, flags := uint16(unix.RTM_DELADDR), uint16(0)
+	if add {
+		kind, flags = unix.RTM_NEWADDR, unix.NLM_F_CREATE|unix.NLM_F_REPLACE
+	}
+
+	return nlrequest(kind, flags, header, nlattribute(unix.IFA_LOCAL, ip), nlattribute(unix.IFA_ADDRESS, ip), nlattribute(unix.IFA_BROADCAST, broadcast))
+}
+
+// routes without gateway (or with a 0.0.0.0 gateway, RFC 3442) are directly reachable on the interface link
+func InterfaceRoute(device string, destination *net.IPNet, gateway net.IP, add bool) error {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return err
+	}
+	ones, _ := destination.Mask.Size()
+	header := make([]byte, unix.SizeofRtMsg)
+	header[0], header[1], header[4], header[5], header[6], header[7] = unix.AF_INET, byte(ones), unix.RT_TABLE_MAIN, unix.RTPROT_DHCP, unix.RT_SCOPE_UNIVERSE, unix.RTN_UNICAST
+	index := make([]byte, 4)
+	binary.NativeEndian.PutUint32(index, uint32(iface.Index))
+	attributes := [][]byte{nlattribute(unix.RTA_OIF, index)}
+	if ones != 0 {
+		attributes = append(attributes, nlattribute(unix.RTA_DST, destination.IP.To4()))
+	}
+	if gateway == nil || gateway.IsUnspecified() {
+		header[6] = unix.RT_SCOPE_LINK
+
+	} else {
+		attributes = append(attributes, nlattribute(unix.RTA_GATEWAY, gateway.To4()))
+	}
+
+	kind, flags := uint16(unix.RTM_DELROUTE), uint16(0)
+	if add {
+		kind, flags = unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE
+	}
+
+	return nlrequest(kind, flags, header, attributes...)
+}
+
+func InterfaceMTU(device string, mtu int) error {
+	iface, err := net.InterfaceByName(device)
+	if err != nil {
+		return err
+	}
+	header := make([]byte, unix.SizeofIfInfomsg)
+	header[0] = unix.AF_UNSPEC
+	binary.NativeEndian.PutUint32(header[4:], uint32(iface.Index))
+	value := make([]byte, 4)
+	binary.NativeEndian.PutUint32(value, uint32(mtu))
+
+	return nlrequest(unix.RTM_NEWLINK, 0, header, nlattribute(unix.IFLA_MTU, value))
+}
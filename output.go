@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+)
+
+var OUTPUT_FORMATS = map[string]bool{"json": true, "env": true, "networkd": true, "yaml": true}
+
+// option values are flattened to text, lists being space-separated (shell-friendly) and objects JSON-encoded
+func textvalue(value any) string {
+	switch value := value.(type) {
+	case nil:
+		return ""
+
+	case string:
+		return value
+
+	case bool:
+		if value {
+			return "1"
+		}
+		return "0"
+
+	case []any:
+		items := []string{}
+		for _, item := range value {
+			items = append(items, textvalue(item))
+		}
+		return strings.Join(items, " ")
+
+	case map[string]any, FRAME:
+		content, _ := json.Marshal(value)
+		return string(content)
+	}
+
+	return strconv.FormatFloat(j.Number(value), 'f', -1, 64)
+}
+
+func envname(name string) string {
+	return "PDHCP_" + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+func names(frame FRAME) (names []string) {
+	for name := range frame {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return
+}
+
+// JSON-encoded strings are valid YAML double-quoted scalars
+func yamlvalue(value any) string {
+	if content, err := json.Marshal(value); err == nil {
+		return string(content)
+	}
+
+	return `""`
+}
+
+func render(frame FRAME, device, mode string) []byte {
+	output := []string{}
+	switch mode {
+	case "env":
+		for _, name := range names(frame) {
+			output = append(output, envname(name)+"='"+strings.ReplaceAll(textvalue(frame[name]), "'", `'\''`)+"'")
+		}
+
+	case "yaml":
+		for _, name := range names(frame) {
+			if items, ok := frame[name].([]any); ok {
+				if len(items) == 0 {
+					output = append(output, name+": []")
+					continue
+				}
+				output = append(output, name+":")
+				for _, item := range items {
+					output = append(output, "  - "+yamlvalue(item))
+				}
+
+			} else {
+				output = append(output, name+": "+yamlvalue(frame[name]))
+			}
+		}
+
+	case "networkd":
+		output = append(output, "[Match]", "Name="+device, "", "[Network]")
+		for _, server := range strings.Fields(textvalue(frame["domain-name-servers"])) {
+			output = append(output, "DNS="+server)
+		}
+		if domains := strings.Fields(textvalue(frame["domain-name"]) + " " + textvalue(frame["domain-search"])); len(domains) != 0 {
+			output = append(output, "Domains="+strings.Join(domains, " "))
+		}
+		for _, server := range strings.Fields(textvalue(frame["ntp-servers"])) {
+			output = append(output, "NTP="+server)
+		}
+		if network := lease2network(frame); network != nil {
+			output = append(output, "", "[Address]", "Address="+network.Address.String())
+			for _, route := range network.Routes {
+				output = append(output, "", "[Route]")
+				if ones, _ := route.Destination.Mask.Size(); ones != 0 {
+					output = append(output, "Destination="+route.Destination.String())
+				}
+				if route.Gateway.Equal(net.IPv4zero) {
+					output = append(output, "Scope=link")
+
+				} else {
+					output = append(output, "Gateway="+route.Gateway.String())
+				}
+			}
+			if network.MTU >= 68 {
+				output = append(output, "", "[Link]", "MTUBytes="+strconv.Itoa(network.MTU))
+			}
+		}
+
+	default:
+		content, _ := json.Marshal(frame)
+		return content
+	}
+
+	return []byte(strings.Join(output, "\n"))
+}
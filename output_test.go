@@ -0,0 +1,82 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestTextvalue(t *testing.T) {
+	for _, test := range []struct {
+		value    any
+		expected string
+	}{
+		{nil, ""},
+		{"text", "text"},
+		{true, "1"},
+		{false, "0"},
+		{3600, "3600"},
+		{1.5, "1.5"},
+		{[]any{"10.0.0.1", "10.0.0.2"}, "10.0.0.1 10.0.0.2"},
+		{map[string]any{"circuit-id": "eth0"}, `{"circuit-id":"eth0"}`},
+		{FRAME{"remote-id": "00"}, `{"remote-id":"00"}`},
+	} {
+		if actual := textvalue(test.value); actual != test.expected {
+			t.Errorf("textvalue(%v) = %q, expected %q", test.value, actual, test.expected)
+		}
+	}
+}
+
+func TestRender(t *testing.T) {
+	frame := FRAME{
+		"bootp-assigned-address": "192.168.1.17",
+		"subnet-mask":            "255.255.255.0",
+		"routers":                []any{"192.168.1.1"},
+		"domain-name-servers":    []any{"192.168.1.2", "192.168.1.3"},
+		"domain-name":            "example.com",
+		"hostname":               "it's",
+		"interface-mtu":          1400,
+		"domain-search":          []any{},
+	}
+	for _, test := range []struct {
+		mode     string
+		expected string
+	}{
+		{"env", strings.Join([]string{
+			"PDHCP_BOOTP_ASSIGNED_ADDRESS='192.168.1.17'",
+			"PDHCP_DOMAIN_NAME='example.com'",
+			"PDHCP_DOMAIN_NAME_SERVERS='192.168.1.2 192.168.1.3'",
+			"PDHCP_DOMAIN_SEARCH=''",
+			`PDHCP_HOSTNAME='it'\''s'`,
+			"PDHCP_INTERFACE_MTU='1400'",
+			"PDHCP_ROUTERS='192.168.1.1'",
+			"PDHCP_SUBNET_MASK='255.255.255.0'",
+		}, "\n")},
+		{"yaml", strings.Join([]string{
+			`bootp-assigned-address: "192.168.1.17"`,
+			`domain-name: "example.com"`,
+			"domain-name-servers:",
+			`  - "192.168.1.2"`,
+			`  - "192.168.1.3"`,
+			"domain-search: []",
+			`hostname: "it's"`,
+			"interface-mtu: 1400",
+			"routers:",
+			`  - "192.168.1.1"`,
+			`subnet-mask: "255.255.255.0"`,
+		}, "\n")},
+		{"networkd", strings.Join([]string{
+			"[Match]", "Name=eth0", "",
+			"[Network]", "DNS=192.168.1.2", "DNS=192.168.1.3", "Domains=example.com", "",
+			"[Address]", "Address=192.168.1.17/24", "",
+			"[Route]", "Gateway=192.168.1.1", "",
+			"[Link]", "MTUBytes=1400",
+		}, "\n")},
+	} {
+		if actual := string(render(frame, "eth0", test.mode)); actual != test.expected {
+			t.Errorf("render(%s) =\n%s\nexpected\n%s", test.mode, actual, test.expected)
+		}
+	}
+	if actual := string(render(FRAME{"hostname": "host"}, "eth0", "json")); actual != `{"hostname":"host"}` {
+		t.Errorf("render(json) = %s", actual)
+	}
+}
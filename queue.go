@@ -0,0 +1,149 @@
+package main
+
+import (
+	"sync"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+	"github.com/pyke369/golang-support/ulog"
+)
+
+type QITEM struct {
+	frame      FRAME
+	client     string
+	retransmit bool
+}
+
+type QUEUE struct {
+	name    string
+	size    int
+	items   []*QITEM
+	drops   map[string]int
+	output  chan FRAME
+	signal  chan struct{}
+	logger  *ulog.ULog
+	release func(FRAME)
+	mu      sync.Mutex
+}
+
+func NewQueue(name string, size int, logger *ulog.ULog, release func(FRAME)) (q *QUEUE) {
+	q = &QUEUE{
+		name:    name,
+		size:    max(1, size),
+		items:   []*QITEM{},
+		drops:   map[string]int{},
+		output:  make(chan FRAME),
+		signal:  make(chan struct{}, 1),
+		logger:  logger,
+		release: release,
+	}
+	go func() {
+		for range q.signal {
+			for {
+				q.mu.Lock()
+				if len(q.items) == 0 {
+					q.mu.Unlock()
+					break
+				}
+				item := q.items[0]
+				q.items = q.items[1:]
+				q.mu.Unlock()
+				q.output <- item.frame
+			}
+		}
+	}()
+
+	return
+}
+
+func (q *QUEUE) Push(frame FRAME) bool {
+	item := &QITEM{frame: frame, client: v4client(frame), retransmit: j.Number(frame["bootp-start-time"]) > 0}
+
+	q.mu.Lock()
+	for _, queued := range q.items {
+		if queued.client == item.client {
+			item.retransmit = true
+			break
+		}
+	}
+	var evicted *QITEM
+	if len(q.items) >= q.size {
+		// make room by evicting the oldest retransmitted request, first-seen requests are never evicted
+		index := -1
+		for position, queued := range q.items {
+			if queued.retransmit {
+				index = position
+				break
+			}
+		}
+		if index < 0 {
+			q.mu.Unlock()
+			q.Drop(frame, "queue full")
+			if q.release != nil {
+				q.release(frame)
+			}
+			return false
+		}
+		evicted = q.items[index]
+		q.items = append(q.items[:index], q.items[index+1:]...)
+	}
+	q.items = append(q.items, item)
+	q.mu.Unlock()
+	if evicted != nil {
+		q.Drop(evicted.frame, "retransmit evicted")
+		if q.release != nil {
+			q.release(evicted.frame)
+		}
+	}
+
+	select {
+	case q.signal <- struct{}{}:
+
+	default:
+	}
+
+	return true
+}
+
+func (q *QUEUE) Drain() (frames []FRAME) {
+	q.mu.Lock()
+	for _, item := range q.items {
+		frames = append(frames, item.frame)
+	}
+	q.items = []*QITEM{}
+	q.mu.Unlock()
+
+	return
+}
+
+func (q *QUEUE) Drop(frame FRAME, reason string) {
+	q.mu.Lock()
+	q.drops[reason]++
+	q.mu.Unlock()
+	q.logger.Warn(map[string]any{
+		"event":  "drop",
+		"queue":  q.name,
+		"type":   j.String(frame["dhcp-message-type"]),
+		"txid":   j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"]),
+		"reason": reason,
+	})
+}
+
+func (q *QUEUE) Stats() map[string]any {
+	drops, total := map[string]any{}, 0
+	q.mu.Lock()
+	for reason, count := range q.drops {
+		drops[reason] = count
+		total += count
+	}
+	stats := map[string]any{
+		"name":    q.name,
+		"size":    q.size,
+		"depth":   len(q.items),
+		"usage":   len(q.items) * 100 / q.size,
+		"drops":   drops,
+		"dropped": total,
+	}
+	q.mu.Unlock()
+
+	return stats
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/pyke369/golang-support/ulog"
+)
+
+func testqueue(size int, release func(FRAME)) *QUEUE {
+	return &QUEUE{name: "test", size: size, drops: map[string]int{}, signal: make(chan struct{}, 1), logger: ulog.New(""), release: release}
+}
+
+func TestQueueEviction(t *testing.T) {
+	released := []string{}
+	queue := testqueue(2, func(frame FRAME) {
+		released = append(released, frame["client-hardware-address"].(string))
+	})
+
+	if !queue.Push(FRAME{"client-hardware-address": "00:00:00:00:00:01", "bootp-start-time": 4}) ||
+		!queue.Push(FRAME{"client-hardware-address": "00:00:00:00:00:02"}) {
+		t.Fatal("push into non-full queue failed")
+	}
+	// the retransmitted request is evicted in favor of the new one
+	if !queue.Push(FRAME{"client-hardware-address": "00:00:00:00:00:03"}) {
+		t.Fatal("push evicting a retransmitted request failed")
+	}
+	// no retransmitted request left, the new request is dropped
+	if queue.Push(FRAME{"client-hardware-address": "00:00:00:00:00:04"}) {
+		t.Fatal("push into queue holding first-seen requests only succeeded")
+	}
+
+	if len(queue.items) != 2 || queue.items[0].client != "00:00:00:00:00:02" || queue.items[1].client != "00:00:00:00:00:03" {
+		t.Errorf("unexpected queue content %v", queue.Drain())
+	}
+	if len(released) != 2 || released[0] != "00:00:00:00:00:01" || released[1] != "00:00:00:00:00:04" {
+		t.Errorf("unexpected released frames %v", released)
+	}
+	if queue.drops["retransmit evicted"] != 1 || queue.drops["queue full"] != 1 {
+		t.Errorf("unexpected drops %v", queue.drops)
+	}
+}
+
+func TestQueueConcurrentPush(t *testing.T) {
+	queue := testqueue(8, nil)
+	for index := 0; index < 8; index++ {
+		queue.Push(FRAME{"client-hardware-address": "00:00:00:00:01:0" + strconv.Itoa(index), "bootp-start-time": 1})
+	}
+
+	var wait sync.WaitGroup
+	for index := 0; index < 64; index++ {
+		wait.Add(1)
+		go func() {
+			queue.Push(FRAME{"client-hardware-address": "00:00:00:00:02:00", "bootp-start-time": 1})
+			wait.Done()
+		}()
+	}
+	wait.Wait()
+	if len(queue.items) > queue.size {
+		t.Errorf("queue grew past its size (%d > %d)", len(queue.items), queue.size)
+	}
+}
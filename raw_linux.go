@@ -8,6 +8,8 @@ import (
 	"errors"
 	"net"
 	"os"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -277,6 +279,118 @@ func (c *Conn) WriteTo(from, to *Addr, data []byte) (n int, err error) {
 	return len(data), nil
 }
 
+// RFC 5227 address probing: ARP probes are sent over the packet socket after a random delay (up to wait), and spaced
+// randomly between wait and 2 x wait (2 x wait after the last one); any ARP packet from another hardware address using
+// the probed address as sender address (or probing the same address) is a conflict
+func (c *Conn) Probe(address net.IP, count int, wait time.Duration) (conflict net.HardwareAddr, err error) {
+	target := address.To4()
+	if c.version != 4 || target == nil || c.Local.HardwareAddr == nil {
+		return nil, errors.New("invalid probe address")
+	}
+	iface, err := net.InterfaceByName(c.Local.Device)
+	if err != nil {
+		return nil, err
+	}
+	ethertype := (syscall.ETH_P_ARP << 8) | (syscall.ETH_P_ARP >> 8)
+	handle, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, ethertype)
+	if err != nil {
+		return nil, err
+	}
+	if err := syscall.SetNonblock(handle, true); err != nil {
+		syscall.Close(handle)
+		return nil, err
+	}
+	if err := syscall.Bind(handle, &syscall.SockaddrLinklayer{Protocol: uint16(ethertype), Ifindex: iface.Index}); err != nil {
+		syscall.Close(handle)
+		return nil, err
+	}
+	conn := os.NewFile(uintptr(handle), "arpconn"+ustr.Int(handle))
+	if conn == nil {
+		syscall.Close(handle)
+		return nil, errors.New("arpconn failed")
+	}
+
+	payload := []byte{
+		// ETH destination address (broadcast)
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff,
+		// ETH source address (overwritten below)
+		0, 0, 0, 0, 0, 0,
+		// ETH ethertype
+		byte(syscall.ETH_P_ARP >> 8), byte(syscall.ETH_P_ARP & 0xff),
+		// ARP hardware type + protocol type + hardware length + protocol length + operation (request)
+		0x00, 0x01, 0x08, 0x00, 6, 4, 0x00, 0x01,
+		// ARP sender hardware address (overwritten below) + sender protocol address (unspecified)
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		// ARP target hardware address (unspecified) + target protocol address (overwritten below)
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	}
+	copy(payload[6:], c.Local.HardwareAddr)
+	copy(payload[22:], c.Local.HardwareAddr)
+	copy(payload[38:], target)
+
+	data := make([]byte, 1<<10)
+	time.Sleep(time.Duration(uhash.Rand(int(wait) + 1)))
+	for probe := 1; probe <= count && conflict == nil; probe++ {
+		if _, err = c.conn.Write(payload); err != nil {
+			break
+		}
+		deadline := time.Now().Add(wait + time.Duration(uhash.Rand(int(wait)+1)))
+		if probe == count {
+			deadline = time.Now().Add(2 * wait)
+		}
+		conn.SetReadDeadline(deadline)
+		for {
+			read, rerr := conn.Read(data)
+			if rerr != nil {
+				break
+			}
+			if read < 42 || binary.BigEndian.Uint16(data[12:]) != syscall.ETH_P_ARP || binary.BigEndian.Uint16(data[16:]) != syscall.ETH_P_IP ||
+				data[18] != 6 || data[19] != 4 || bytes.Equal(data[22:28], c.Local.HardwareAddr) {
+				continue
+			}
+			if bytes.Equal(data[28:32], target) || (binary.BigEndian.Uint16(data[20:]) == 1 && bytes.Equal(data[28:32], net.IPv4zero.To4()) && bytes.Equal(data[38:42], target)) {
+				conflict = append(net.HardwareAddr{}, data[22:28]...)
+				break
+			}
+		}
+	}
+	conn.Close()
+
+	return
+}
+
 func BindToDevice(handle int, name string) error {
 	return syscall.SetsockoptString(handle, syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, name)
 }
+
+func PeerCredentials(conn *net.UnixConn) (pid, uid, gid int, err error) {
+	var credentials *syscall.Ucred
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	if err := raw.Control(func(handle uintptr) {
+		credentials, err = syscall.GetsockoptUcred(int(handle), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, 0, 0, err
+	}
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	return int(credentials.Pid), int(credentials.Uid), int(credentials.Gid), nil
+}
+
+func Vlan(name string) int {
+	if content, err := os.ReadFile("/proc/net/vlan/config"); err == nil {
+		for _, line := range strings.Split(string(content), "\n") {
+			if parts := strings.Split(line, "|"); len(parts) == 3 && strings.TrimSpace(parts[0]) == name {
+				vlan, _ := strconv.Atoi(strings.TrimSpace(parts[1]))
+				return vlan
+			}
+		}
+	}
+
+	return 0
+}
@@ -4,6 +4,7 @@ package main
 
 import (
 	"errors"
+	"net"
 	"time"
 )
 
@@ -30,3 +31,27 @@ func (c *Conn) WriteTo(from, to *Addr, data []byte) (n int, err error) {
 func BindToDevice(handle int, name string) error {
 	return nil
 }
+
+func PeerCredentials(conn *net.UnixConn) (pid, uid, gid int, err error) {
+	return 0, 0, 0, errors.ErrUnsupported
+}
+
+func Vlan(name string) int {
+	return 0
+}
+
+func InterfaceAddress(device string, address *net.IPNet, add bool) error {
+	return errors.ErrUnsupported
+}
+
+func InterfaceRoute(device string, destination *net.IPNet, gateway net.IP, add bool) error {
+	return errors.ErrUnsupported
+}
+
+func InterfaceMTU(device string, mtu int) error {
+	return errors.ErrUnsupported
+}
+
+func (c *Conn) Probe(address net.IP, count int, wait time.Duration) (conflict net.HardwareAddr, err error) {
+	return nil, errors.ErrUnsupported
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	j "github.com/pyke369/golang-support/jsonrpc"
+	"github.com/pyke369/golang-support/ulog"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+const SCRIPT_STEPS = 10_000_000
+
+func starvalue(value any) starlark.Value {
+	switch value := value.(type) {
+	case nil:
+		return starlark.None
+
+	case bool:
+		return starlark.Bool(value)
+
+	case int:
+		return starlark.MakeInt64(int64(value))
+
+	case int8:
+		return starlark.MakeInt64(int64(value))
+
+	case int16:
+		return starlark.MakeInt64(int64(value))
+
+	case int32:
+		return starlark.MakeInt64(int64(value))
+
+	case int64:
+		return starlark.MakeInt64(value)
+
+	case uint:
+		return starlark.MakeUint64(uint64(value))
+
+	case uint8:
+		return starlark.MakeUint64(uint64(value))
+
+	case uint16:
+		return starlark.MakeUint64(uint64(value))
+
+	case uint32:
+		return starlark.MakeUint64(uint64(value))
+
+	case uint64:
+		return starlark.MakeUint64(value)
+
+	case float64:
+		if value == float64(int64(value)) {
+			return starlark.MakeInt64(int64(value))
+		}
+		return starlark.Float(value)
+
+	case string:
+		return starlark.String(value)
+
+	case []any:
+		list := make([]starlark.Value, 0, len(value))
+		for _, item := range value {
+			list = append(list, starvalue(item))
+		}
+		return starlark.NewList(list)
+
+	case map[string]any:
+		dict := starlark.NewDict(len(value))
+		for name, item := range value {
+			dict.SetKey(starlark.String(name), starvalue(item))
+		}
+		return dict
+
+	case FRAME:
+		return starvalue(map[string]any(value))
+	}
+
+	return starlark.None
+}
+
+func govalue(value starlark.Value) any {
+	switch value := value.(type) {
+	case starlark.Bool:
+		return bool(value)
+
+	case starlark.Int:
+		number, _ := value.Int64()
+		return number
+
+	case starlark.Float:
+		return float64(value)
+
+	case starlark.String:
+		return string(value)
+
+	case starlark.Indexable:
+		list := []any{}
+		for index := range value.Len() {
+			list = append(list, govalue(value.Index(index)))
+		}
+		return list
+
+	case *starlark.Dict:
+		dict := map[string]any{}
+		for _, item := range value.Items() {
+			if name, ok := item[0].(starlark.String); ok {
+				dict[string(name)] = govalue(item[1])
+			}
+		}
+		return dict
+	}
+
+	return nil
+}
+
+func loadscript(path string, predeclared starlark.StringDict) (starlark.Callable, error) {
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, &starlark.Thread{Name: path}, path, nil, predeclared)
+	if err != nil {
+		return nil, err
+	}
+	handler, ok := globals["handle"].(starlark.Callable)
+	if !ok {
+		return nil, errors.New("missing handle(frame) function in " + path)
+	}
+
+	return handler, nil
+}
+
+func scriptbackend(backend string, workers, timeout int, requests *QUEUE, dispatch func(*ENVELOPE, string, string, string, map[string]any), release func(FRAME), logger *ulog.ULog) {
+	remote, err := url.Parse(backend)
+	if err != nil {
+		bail(err.Error())
+	}
+	path, hosts := remote.Path, remote.Query().Get("hosts")
+
+	var (
+		mu     sync.RWMutex
+		leases *LEASES
+	)
+
+	predeclared := starlark.StringDict{
+		"cidr": starlark.NewBuiltin("cidr", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			if len(args) < 2 {
+				return nil, errors.New("cidr: expected an address and at least one network")
+			}
+			address := net.ParseIP(j.String(govalue(args[0])))
+			if address == nil {
+				return starlark.False, nil
+			}
+			for _, network := range args[1:] {
+				if _, network, err := net.ParseCIDR(j.String(govalue(network))); err == nil && network.Contains(address) {
+					return starlark.True, nil
+				}
+			}
+			return starlark.False, nil
+		}),
+		"lease": starlark.NewBuiltin("lease", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			var frame *starlark.Dict
+			if err := starlark.UnpackPositionalArgs("lease", args, kwargs, 1, &frame); err != nil {
+				return nil, err
+			}
+			mu.RLock()
+			current := leases
+			mu.RUnlock()
+			if current == nil {
+				return starlark.None, nil
+			}
+			if reply := current.Lookup(FRAME(govalue(frame).(map[string]any))); reply != nil {
+				return starvalue(reply), nil
+			}
+			return starlark.None, nil
+		}),
+		"log": starlark.NewBuiltin("log", func(thread *starlark.Thread, fn *starlark.Builtin, args starlark.Tuple, kwargs []starlark.Tuple) (starlark.Value, error) {
+			log := map[string]any{"event": "script", "local": path}
+			if len(args) > 0 {
+				log["message"] = govalue(args[0])
+			}
+			for _, kwarg := range kwargs {
+				log[string(kwarg[0].(starlark.String))] = govalue(kwarg[1])
+			}
+			logger.Info(log)
+			return starlark.None, nil
+		}),
+	}
+
+	handler, err := loadscript(path, predeclared)
+	if err != nil {
+		bail(err.Error())
+	}
+	if hosts != "" {
+		if leases, err = loadleases(hosts); err != nil {
+			bail(err.Error())
+		}
+	}
+	logger.Info(map[string]any{"event": "start", "local": path})
+
+	// the script (and the optional hosts file) are polled for changes and reloaded in place,
+	// the previous version being kept if invalid
+	go func() {
+		info, _ := modified(path, nil)
+		hinfo, _ := modified(hosts, nil)
+		for range time.Tick(2 * time.Second) {
+			changed := false
+			if info, changed = modified(path, info); changed {
+				if updated, err := loadscript(path, predeclared); err == nil {
+					mu.Lock()
+					handler = updated
+					mu.Unlock()
+					logger.Info(map[string]any{"event": "reload", "local": path})
+
+				} else {
+					logger.Warn(map[string]any{"event": "reload", "local": path, "reason": err.Error()})
+				}
+			}
+			if hosts == "" {
+				continue
+			}
+			if hinfo, changed = modified(hosts, hinfo); changed {
+				if updated, err := loadleases(hosts); err == nil {
+					mu.Lock()
+					leases = updated
+					mu.Unlock()
+					logger.Info(map[string]any{"event": "reload", "local": hosts, "hosts": len(updated.Hosts), "subnets": len(updated.subnets)})
+
+				} else {
+					logger.Warn(map[string]any{"event": "reload", "local": hosts, "reason": err.Error()})
+				}
+			}
+		}
+	}()
+
+	for range max(1, workers) {
+		go func() {
+			for frame := range requests.output {
+				mu.RLock()
+				current := handler
+				mu.RUnlock()
+
+				// each call runs in its own sandboxed thread, bounded in steps and duration
+				thread := &starlark.Thread{Name: path}
+				thread.SetMaxExecutionSteps(SCRIPT_STEPS)
+				timer := time.AfterFunc(time.Duration(timeout)*time.Second, func() { thread.Cancel("timeout") })
+				value, err := starlark.Call(thread, current, starlark.Tuple{starvalue(frame)}, nil)
+				timer.Stop()
+				if err != nil {
+					logger.Warn(map[string]any{
+						"event":  "recv",
+						"type":   j.String(frame["dhcp-message-type"]),
+						"txid":   j.String(frame["client-hardware-address"]) + "/" + j.String(frame["bootp-transaction-id"]),
+						"local":  path,
+						"reason": err.Error(),
+					})
+					release(frame)
+					continue
+				}
+
+				// the returned value is handled as any backend reply (frame, list of frames or envelope), None meaning no reply
+				var result any
+				switch value := value.(type) {
+				case starlark.NoneType:
+					release(frame)
+					continue
+
+				case *starlark.List, starlark.Tuple:
+					result = map[string]any{"frames": govalue(value)}
+
+				default:
+					result = govalue(value)
+				}
+				if payload, err := json.Marshal(result); err == nil {
+					if reply, err := unwrap(payload); err == nil {
+						dispatch(reply, v4key(frame), "script", backend, map[string]any{"local": path})
+						continue
+					}
+				}
+				release(frame)
+			}
+		}()
+	}
+}
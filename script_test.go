@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"go.starlark.net/starlark"
+)
+
+func TestStarvalueParsedFrame(t *testing.T) {
+	packet, err := v4build(FRAME{
+		"bootp-opcode":            "reply",
+		"bootp-transaction-id":    "01020304",
+		"bootp-start-time":        7,
+		"client-hardware-address": "00:11:22:33:44:55",
+		"dhcp-message-type":       "ack",
+		"address-lease-time":      3600,
+		"interface-mtu":           1400,
+		"routers":                 []any{"192.168.0.1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame, err := v4parse(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dict, ok := starvalue(frame).(*starlark.Dict)
+	if !ok {
+		t.Fatalf("frame converted to %T", starvalue(frame))
+	}
+	for name, expected := range map[string]int64{"bootp-start-time": 7, "address-lease-time": 3600, "interface-mtu": 1400, "bootp-relay-hops": 0} {
+		value, found, _ := dict.Get(starlark.String(name))
+		number, ok := value.(starlark.Int)
+		if !found || !ok {
+			t.Errorf("%s converted to %v (%T)", name, value, value)
+			continue
+		}
+		if actual, _ := number.Int64(); actual != expected {
+			t.Errorf("%s = %d, expected %d", name, actual, expected)
+		}
+	}
+	if value, _, _ := dict.Get(starlark.String("routers")); value == nil || value.String() != `["192.168.0.1"]` {
+		t.Errorf("routers converted to %v", value)
+	}
+}
+
+func TestStarvalueScalars(t *testing.T) {
+	for _, test := range []struct {
+		value    any
+		expected string
+	}{
+		{nil, "None"},
+		{true, "True"},
+		{int(-3), "-3"},
+		{int64(1 << 40), "1099511627776"},
+		{uint8(255), "255"},
+		{uint64(1 << 63), "9223372036854775808"},
+		{float64(12), "12"},
+		{1.5, "1.5"},
+		{"text", `"text"`},
+		{[]any{1, "a"}, `[1, "a"]`},
+	} {
+		if actual := starvalue(test.value).String(); actual != test.expected {
+			t.Errorf("starvalue(%#v) = %s, expected %s", test.value, actual, test.expected)
+		}
+	}
+}
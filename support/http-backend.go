@@ -1,16 +1,22 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -31,15 +37,240 @@ type LEASE struct {
 	State    string `json:"state"`
 	Deadline int64  `json:"deadline"`
 	Renewed  int64  `json:"renewed"`
+	Version  int64  `json:"version,omitempty"`
+	Node     string `json:"node,omitempty"`
+}
+
+// replicated changes are resolved by version (the last writer wins), ties by node name
+func (l LEASE) newer(other LEASE) bool {
+	return l.Version > other.Version || (l.Version == other.Version && l.Node > other.Node)
+}
+
+// reservations and holds set through the API without deadline never expire
+func (l LEASE) expired(now int64) bool {
+	return l.Deadline <= now && !(l.Deadline == 0 && (l.State == "reserved" || l.State == "hold"))
+}
+
+type JENTRY struct {
+	Address string `json:"address"`
+	Lease   *LEASE `json:"lease,omitempty"`
+}
+
+type PEER struct {
+	url     string
+	pending map[string]JENTRY
+	signal  chan struct{}
 }
 
 var (
-	config    *uconfig.UConfig
-	log, alog *ulog.ULog
-	leases    = map[string]LEASE{}
-	lock      sync.RWMutex
+	config       *uconfig.UConfig
+	log, alog    *ulog.ULog
+	leases       = map[string]LEASE{}
+	lock         sync.RWMutex
+	journal      *os.File
+	fsync        string
+	node         string
+	peers        []*PEER
+	split, share uint32
 )
 
+// each lease change is appended to the journal (as a checksummed JSON line) before being used, the journal being
+// periodically compacted into an atomically replaced snapshot
+func record(address string, lease *LEASE) {
+	if journal == nil {
+		return
+	}
+	payload, _ := json.Marshal(JENTRY{Address: address, Lease: lease})
+	if _, err := journal.WriteString(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE(payload), payload)); err != nil {
+		log.Warn(map[string]any{"event": "error", "error": fmt.Sprintf("cannot write leases journal (%v)", err)})
+		return
+	}
+	if fsync == "always" {
+		journal.Sync()
+	}
+}
+
+// local changes are versioned and queued for replication to all peers
+func replicate(address string, lease LEASE) {
+	for _, peer := range peers {
+		peer.pending[address] = JENTRY{Address: address, Lease: &lease}
+		select {
+		case peer.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func store(address string, lease LEASE) {
+	current, ok := leases[address]
+	if ok {
+		lease.Version, lease.Node = current.Version, current.Node
+		if current == lease {
+			return
+		}
+	}
+	lease.Version, lease.Node = max(time.Now().UnixNano(), current.Version+1), node
+	leases[address] = lease
+	record(address, &lease)
+	replicate(address, lease)
+}
+
+// deleted leases are kept as versioned tombstones for a while, so that stale replicated copies can't resurrect them
+func remove(address string) {
+	if current, ok := leases[address]; ok && current.State != "deleted" {
+		now := time.Now()
+		lease := LEASE{
+			State:    "deleted",
+			Deadline: now.Add(config.DurationBounds("backend.retention", 86400, 60, 30*86400)).Unix(),
+			Version:  max(now.UnixNano(), current.Version+1),
+			Node:     node,
+		}
+		leases[address] = lease
+		record(address, &lease)
+		replicate(address, lease)
+	}
+}
+
+// remote changes are only applied if more recent than the local version (and never replicated back)
+func apply(address string, lease LEASE) bool {
+	if current, ok := leases[address]; ok && !lease.newer(current) {
+		return false
+	}
+	leases[address] = lease
+	record(address, &lease)
+	return true
+}
+
+// replicated batches are authenticated with the peers token (an empty reason meaning success)
+func send(location string, entries []JENTRY) (reason string) {
+	payload, _ := json.Marshal(entries)
+	request, err := http.NewRequest(http.MethodPost, location, bytes.NewReader(payload))
+	if err != nil {
+		return err.Error()
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set("Authorization", "Bearer "+config.String("backend.peer_token"))
+	client := &http.Client{Timeout: 5 * time.Second}
+	response, err := client.Do(request)
+	if err != nil {
+		return err.Error()
+	}
+	io.Copy(io.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		return fmt.Sprintf("HTTP status %d", response.StatusCode)
+	}
+	return ""
+}
+
+func push(peer *PEER) {
+	backoff := time.Second
+	for {
+		select {
+		case <-peer.signal:
+		case <-time.After(time.Second):
+		}
+		lock.Lock()
+		entries := []JENTRY{}
+		for _, entry := range peer.pending {
+			entries = append(entries, entry)
+		}
+		peer.pending = map[string]JENTRY{}
+		lock.Unlock()
+		if len(entries) == 0 {
+			continue
+		}
+
+		reason := send(peer.url, entries)
+		if reason == "" {
+			backoff = time.Second
+			continue
+		}
+
+		// failed entries are queued again (unless superseded in the meantime) and retried with exponential backoff
+		lock.Lock()
+		for _, entry := range entries {
+			if _, ok := peer.pending[entry.Address]; !ok {
+				peer.pending[entry.Address] = entry
+			}
+		}
+		lock.Unlock()
+		log.Warn(map[string]any{"event": "replicate", "peer": peer.url, "entries": len(entries), "error": reason})
+		time.Sleep(backoff)
+		backoff = min(30*time.Second, backoff*2)
+	}
+}
+
+func load(path string) (err error) {
+	if content, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(content, &leases); err != nil {
+			return fmt.Errorf("corrupted leases snapshot %s (%v)", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if content, err := os.ReadFile(path + ".journal"); err == nil {
+		lines := strings.Split(string(content), "\n")
+		if last := lines[len(lines)-1]; last != "" {
+			// a torn last entry was never acknowledged to any client and can be safely ignored
+			log.Warn(map[string]any{"event": "load", "journal": path + ".journal", "error": "ignoring incomplete last entry"})
+		}
+		for index, line := range lines[:len(lines)-1] {
+			var entry JENTRY
+
+			checksum, payload, _ := strings.Cut(line, " ")
+			if checksum != fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(payload))) || json.Unmarshal([]byte(payload), &entry) != nil || entry.Address == "" {
+				return fmt.Errorf("corrupted leases journal %s (line %d)", path+".journal", index+1)
+			}
+			if entry.Lease != nil {
+				leases[entry.Address] = *entry.Lease
+			} else {
+				delete(leases, entry.Address)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	now := time.Now().Unix()
+	for address, lease := range leases {
+		if lease.expired(now) {
+			delete(leases, address)
+		}
+	}
+	return nil
+}
+
+func compact(path string) (err error) {
+	content, err := json.Marshal(leases)
+	if err != nil {
+		return err
+	}
+	handle, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err = handle.Write(content); err == nil {
+		err = handle.Sync()
+	}
+	handle.Close()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	if directory, err := os.Open(filepath.Dir(path)); err == nil {
+		directory.Sync()
+		directory.Close()
+	}
+	if journal != nil {
+		return journal.Truncate(0)
+	}
+	return nil
+}
+
 func please(request map[string]any, duration int64, first, last net.IP) (output string) {
 	client, start, end, caddress, raddress := "", binary.BigEndian.Uint32(first), binary.BigEndian.Uint32(last), "", ""
 	if value, ok := request["client-hardware-address"].(string); ok {
@@ -67,6 +298,12 @@ func please(request map[string]any, duration int64, first, last net.IP) (output
 	for index := start; index <= end; index++ {
 		address := net.IPv4(byte(index>>24), byte(index>>16), byte(index>>8), byte(index)).String()
 		if lease, ok := leases[address]; ok && lease.Client == client {
+			if lease.State == "reserved" {
+				if caddress == "" || caddress == address {
+					output = address
+				}
+				break
+			}
 			if caddress != "" {
 				if caddress == address && lease.State == "lease" {
 					output = address
@@ -80,15 +317,15 @@ func please(request map[string]any, duration int64, first, last net.IP) (output
 					lease.Deadline = time.Now().Add(time.Duration(duration) * time.Second).Unix()
 				}
 			}
-			leases[address] = lease
+			store(address, lease)
 			break
 		}
 	}
 	if output == "" && caddress == "" && raddress == "" {
 		for index := start; index <= end; index++ {
 			address := net.IPv4(byte(index>>24), byte(index>>16), byte(index>>8), byte(index)).String()
-			if _, ok := leases[address]; !ok {
-				leases[address] = LEASE{Client: client, State: "prelease", Deadline: time.Now().Add(10 * time.Second).Unix()}
+			if lease, ok := leases[address]; (!ok || lease.State == "deleted") && (split == 0 || index%split == share) {
+				store(address, LEASE{Client: client, State: "prelease", Deadline: time.Now().Add(10 * time.Second).Unix()})
 				output = address
 				break
 			}
@@ -215,19 +452,237 @@ func build(input, request map[string]any, path string) (output map[string]any) {
 	return output
 }
 
-func handler(response http.ResponseWriter, request *http.Request) {
-	var frame map[string]any
+// tokens may only be sniffed on plain-HTTP listeners if the caller is local
+func secure(request *http.Request) bool {
+	if request.TLS != nil {
+		return true
+	}
+	host, _, _ := net.SplitHostPort(request.RemoteAddr)
+	return net.ParseIP(host).IsLoopback()
+}
 
-	if request.Method == http.MethodGet && request.URL.Path == "/leases" {
-		// TODO add IP/credentials-based ACL check
-		lock.RLock()
-		if content, err := json.Marshal(leases); err != nil {
+// API callers are identified by a named token (Authorization: Bearer <token>), the peers replication token or a verified
+// client certificate, tokens being refused over plain HTTP from remote callers
+func caller(request *http.Request) string {
+	if value, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); ok && value != "" {
+		if !secure(request) {
+			log.Warn(map[string]any{"event": "error", "error": "refusing token over plain HTTP", "remote": request.RemoteAddr})
+			return ""
+		}
+		if token := config.String("backend.peer_token"); token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(value)) == 1 {
+			return "peer"
+		}
+		for _, path := range config.Paths("backend.api.tokens") {
+			if subtle.ConstantTimeCompare([]byte(config.String(path)), []byte(value)) == 1 {
+				return "token:" + strings.TrimPrefix(path, "backend.api.tokens.")
+			}
+		}
+	}
+	if request.TLS != nil && len(request.TLS.VerifiedChains) > 0 {
+		subject := request.TLS.VerifiedChains[0][0].Subject.CommonName
+		subjects := config.Strings("backend.api.subjects")
+		if len(subjects) == 0 || slices.Contains(subjects, subject) {
+			return "certificate:" + subject
+		}
+	}
+	return ""
+}
+
+func contains(arange, value string) bool {
+	address := net.ParseIP(value)
+	if address == nil {
+		return false
+	}
+	if _, network, err := net.ParseCIDR(arange); err == nil {
+		return network.Contains(address)
+	}
+	if parts := strings.Split(arange, "-"); len(parts) == 2 {
+		if first, last := net.ParseIP(strings.TrimSpace(parts[0])).To4(), net.ParseIP(strings.TrimSpace(parts[1])).To4(); first != nil && last != nil && address.To4() != nil {
+			index := binary.BigEndian.Uint32(address.To4())
+			return index >= binary.BigEndian.Uint32(first) && index <= binary.BigEndian.Uint32(last)
+		}
+	}
+	return false
+}
+
+// leases are designated by address or by client hardware address
+func find(target string) (address string, lease LEASE, ok bool) {
+	if lease, ok = leases[target]; ok && lease.State != "deleted" {
+		return target, lease, true
+	}
+	for address, lease := range leases {
+		if strings.EqualFold(lease.Client, target) && lease.State != "deleted" {
+			return address, lease, true
+		}
+	}
+	return "", LEASE{}, false
+}
+
+func api(response http.ResponseWriter, request *http.Request) {
+	type ENTRY struct {
+		Address string `json:"address"`
+		LEASE
+	}
+
+	actor := caller(request)
+	if actor == "" {
+		response.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	target, action, _ := strings.Cut(strings.TrimPrefix(strings.TrimPrefix(request.URL.Path, "/leases"), "/"), "/")
+
+	// replication batches are only accepted from peers, which may otherwise only list leases (for tables merge)
+	replication, listing := request.Method == http.MethodPost && target == "", request.Method == http.MethodGet && target == ""
+	if (actor == "peer" && !replication && !listing) || (actor != "peer" && replication) {
+		response.WriteHeader(http.StatusForbidden)
+		return
+	}
+	reply := func(status int, value any) {
+		if content, err := json.Marshal(value); err != nil {
 			response.WriteHeader(http.StatusInternalServerError)
 		} else {
 			response.Header().Set("Content-Type", "application/json")
-			response.Write(content)
+			response.WriteHeader(status)
+			response.Write(append(content, '\n'))
+		}
+	}
+	audit := func(action, address string, lease LEASE) {
+		log.Info(map[string]any{
+			"event": "audit", "action": action, "address": address, "client": lease.Client, "state": lease.State,
+			"deadline": lease.Deadline, "actor": actor, "remote": request.RemoteAddr,
+		})
+	}
+
+	switch {
+	case request.Method == http.MethodGet && target == "":
+		query, before := request.URL.Query(), int64(0)
+		if value := query.Get("expiring-before"); value != "" {
+			if before, _ = strconv.ParseInt(value, 10, 64); before == 0 {
+				if value, err := time.Parse(time.RFC3339, value); err == nil {
+					before = value.Unix()
+				} else {
+					response.WriteHeader(http.StatusBadRequest)
+					return
+				}
+			}
 		}
+		selected := map[string]LEASE{}
+		lock.RLock()
+		for address, lease := range leases {
+			if (lease.State == "deleted" && query.Get("state") != "deleted" && query.Get("all") == "") ||
+				(query.Get("pool") != "" && !contains(query.Get("pool"), address)) ||
+				(query.Get("mac") != "" && !strings.EqualFold(query.Get("mac"), lease.Client)) ||
+				(query.Get("state") != "" && query.Get("state") != lease.State) ||
+				(before != 0 && (lease.Deadline == 0 || lease.Deadline >= before)) {
+				continue
+			}
+			selected[address] = lease
+		}
+		lock.RUnlock()
+		reply(http.StatusOK, selected)
+
+	// replication batches pushed by peers
+	case request.Method == http.MethodPost && target == "":
+		var entries []JENTRY
+
+		body, err := io.ReadAll(request.Body)
+		if err != nil || json.Unmarshal(body, &entries) != nil {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		applied := 0
+		lock.Lock()
+		for _, entry := range entries {
+			if entry.Address != "" && entry.Lease != nil && apply(entry.Address, *entry.Lease) {
+				applied++
+			}
+		}
+		lock.Unlock()
+		log.Info(map[string]any{"event": "replicate", "actor": actor, "remote": request.RemoteAddr, "entries": len(entries), "applied": applied})
+		response.WriteHeader(http.StatusNoContent)
+
+	case request.Method == http.MethodGet && action == "":
+		lock.RLock()
+		address, lease, ok := find(target)
 		lock.RUnlock()
+		if !ok {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		reply(http.StatusOK, ENTRY{Address: address, LEASE: lease})
+
+	case request.Method == http.MethodDelete && action == "":
+		lock.Lock()
+		address, lease, ok := find(target)
+		if ok {
+			remove(address)
+		}
+		lock.Unlock()
+		if !ok {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		audit("delete", address, lease)
+		response.WriteHeader(http.StatusNoContent)
+
+	case request.Method == http.MethodPost && action == "expire":
+		lock.Lock()
+		address, lease, ok := find(target)
+		if ok {
+			lease.Deadline = time.Now().Unix()
+			store(address, lease)
+		}
+		lock.Unlock()
+		if !ok {
+			response.WriteHeader(http.StatusNotFound)
+			return
+		}
+		audit("expire", address, lease)
+		reply(http.StatusOK, ENTRY{Address: address, LEASE: lease})
+
+	// reservations bind an address to a client, while holds keep it out of allocation (both possibly until a deadline)
+	case request.Method == http.MethodPut && action == "":
+		var lease LEASE
+
+		if address := net.ParseIP(target); address == nil || address.To4() == nil {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(request.Body)
+		if err != nil || json.Unmarshal(body, &lease) != nil ||
+			(lease.State != "reserved" && lease.State != "hold") || (lease.State == "reserved") != (lease.Client != "") {
+			response.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lease.Renewed = 0
+		lock.Lock()
+		if current, ok := leases[target]; ok && current.State != "deleted" && current.Client != lease.Client && request.URL.Query().Get("force") == "" {
+			lock.Unlock()
+			reply(http.StatusConflict, ENTRY{Address: target, LEASE: current})
+			return
+		}
+		if lease.Client != "" {
+			for address, current := range leases {
+				if address != target && current.Client == lease.Client && current.State != "reserved" {
+					remove(address)
+				}
+			}
+		}
+		store(target, lease)
+		lock.Unlock()
+		audit(lease.State, target, lease)
+		reply(http.StatusOK, ENTRY{Address: target, LEASE: lease})
+
+	default:
+		response.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func handler(response http.ResponseWriter, request *http.Request) {
+	var frame map[string]any
+
+	if request.URL.Path == "/leases" || strings.HasPrefix(request.URL.Path, "/leases/") {
+		api(response, request)
 		return
 	}
 	if request.Method != http.MethodPost {
@@ -241,6 +696,17 @@ func handler(response http.ResponseWriter, request *http.Request) {
 			response.WriteHeader(http.StatusUnprocessableEntity)
 		} else {
 			alog.Info(frame)
+			id := ""
+			if value, ok := frame["frame"].(map[string]any); ok {
+				// enveloped request (pdhcp -E), metadata are made available for matching as meta-<name>
+				id, _ = frame["id"].(string)
+				if meta, ok := frame["meta"].(map[string]any); ok {
+					for name, mvalue := range meta {
+						value["meta-"+name] = mvalue
+					}
+				}
+				frame = value
+			}
 			if _, ok := frame["dhcp-message-type"].(string); !ok {
 				response.WriteHeader(http.StatusPreconditionFailed)
 				return
@@ -276,7 +742,11 @@ func handler(response http.ResponseWriter, request *http.Request) {
 					return
 				}
 				alog.Info(rframe)
-				if payload, err := json.Marshal(rframe); err != nil {
+				var reply any = rframe
+				if id != "" {
+					reply = map[string]any{"id": id, "frame": rframe}
+				}
+				if payload, err := json.Marshal(reply); err != nil {
 					response.WriteHeader(http.StatusInternalServerError)
 				} else {
 					response.Header().Set("Content-Type", "application/json")
@@ -302,10 +772,90 @@ func main() {
 	log.Info(map[string]any{"event": "start", "config": os.Args[1], "pid": os.Getpid(), "version": PROGVER})
 	alog = ulog.New(config.String("backend.access"))
 
+	fsync = config.StringMatch("backend.fsync", "always", "^(always|interval|never)$")
 	if path := config.String("backend.leases"); path != "" {
-		if content, err := os.ReadFile(path); err == nil {
-			json.Unmarshal(content, &leases)
+		// refuse to start on leases corruption rather than handing out addresses already leased to other clients
+		if err := load(path); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot load leases: %v - aborting\n", err)
+			os.Exit(3)
+		}
+		if err := compact(path); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot write leases: %v - aborting\n", err)
+			os.Exit(3)
 		}
+		if journal, err = os.OpenFile(path+".journal", os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0o644); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot open leases journal: %v - aborting\n", err)
+			os.Exit(3)
+		}
+		log.Info(map[string]any{"event": "load", "leases": len(leases), "snapshot": path, "journal": path + ".journal", "fsync": fsync})
+
+		go func() {
+			if fsync == "interval" {
+				for range time.Tick(time.Second) {
+					journal.Sync()
+				}
+			}
+		}()
+		go func() {
+			for range time.Tick(config.DurationBounds("backend.compact", 60, 5, 3600)) {
+				lock.Lock()
+				if err := compact(path); err != nil {
+					log.Warn(map[string]any{"event": "error", "error": fmt.Sprintf("cannot compact leases (%v)", err)})
+				}
+				lock.Unlock()
+			}
+		}()
+	}
+
+	// new addresses are only allocated from this node share of the ranges (e.g. "0/2" and "1/2" for two active nodes),
+	// so that replicated nodes may never hand the same address to different clients
+	node, _ = os.Hostname()
+	node = config.String("backend.node", node)
+	if value := config.String("backend.split"); value != "" {
+		var index, count uint32
+
+		if _, err := fmt.Sscanf(value, "%d/%d", &index, &count); err != nil || count == 0 || index >= count {
+			fmt.Fprintf(os.Stderr, "invalid split value %s - aborting\n", value)
+			os.Exit(2)
+		}
+		share, split = index, count
+	}
+	for _, path := range config.Paths("backend.peers") {
+		peer := &PEER{url: config.String(path), pending: map[string]JENTRY{}, signal: make(chan struct{}, 1)}
+		peers = append(peers, peer)
+		if remote, err := url.Parse(peer.url); err == nil && remote.Scheme != "https" && !net.ParseIP(remote.Hostname()).IsLoopback() && remote.Hostname() != "localhost" {
+			log.Warn(map[string]any{"event": "replicate", "peer": peer.url, "error": "plain HTTP peer will refuse the peers token"})
+		}
+
+		// peers leases are merged at startup, and the whole local table pushed to them
+		if request, err := http.NewRequest(http.MethodGet, peer.url+"?all=1", nil); err == nil {
+			request.Header.Set("Authorization", "Bearer "+config.String("backend.peer_token"))
+			client := &http.Client{Timeout: 5 * time.Second}
+			if response, err := client.Do(request); err == nil {
+				content, _ := io.ReadAll(response.Body)
+				response.Body.Close()
+				pleases := map[string]LEASE{}
+				if response.StatusCode/100 == 2 && json.Unmarshal(content, &pleases) == nil {
+					applied := 0
+					lock.Lock()
+					for address, lease := range pleases {
+						if apply(address, lease) {
+							applied++
+						}
+					}
+					lock.Unlock()
+					log.Info(map[string]any{"event": "replicate", "peer": peer.url, "entries": len(pleases), "applied": applied})
+				}
+			} else {
+				log.Warn(map[string]any{"event": "replicate", "peer": peer.url, "error": err.Error()})
+			}
+		}
+		lock.Lock()
+		for address, lease := range leases {
+			peer.pending[address] = JENTRY{Address: address, Lease: &lease}
+		}
+		lock.Unlock()
+		go push(peer)
 	}
 
 	http.HandleFunc("/", handler)
@@ -314,12 +864,22 @@ func main() {
 			if len(parts) > 1 {
 				certificates := &dynacert.DYNACERT{}
 				certificates.Add("*", parts[1], parts[2])
+				tlsconfig := &tls.Config{}
+				if path := config.String("backend.api.ca"); path != "" {
+					// client certificates are optional, and only used to authenticate API callers
+					if content, err := os.ReadFile(path); err == nil {
+						tlsconfig.ClientCAs, tlsconfig.ClientAuth = x509.NewCertPool(), tls.VerifyClientCertIfGiven
+						tlsconfig.ClientCAs.AppendCertsFromPEM(content)
+					} else {
+						log.Warn(map[string]any{"event": "error", "error": fmt.Sprintf("cannot load API CA certificate (%v)", err)})
+					}
+				}
 				server := &http.Server{
 					Addr:         strings.TrimLeft(parts[0], "*"),
 					ReadTimeout:  config.DurationBounds("backend.read_timeout", 10, 5, 30),
 					IdleTimeout:  config.DurationBounds("backend.idle_timeout", 30, 5, 30),
 					WriteTimeout: config.DurationBounds("backend.write_timeout", 15, 5, 30),
-					TLSConfig:    certificates.TLSConfig(nil),
+					TLSConfig:    certificates.TLSConfig(tlsconfig),
 					TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){},
 				}
 				go func(server *http.Server, parts []string) {
@@ -350,18 +910,23 @@ func main() {
 	go func() {
 		for range time.Tick(5 * time.Second) {
 			if bsync := config.String("backend.sync"); bsync != "" {
-				client := &http.Client{Timeout: 5 * time.Second}
-				if response, err := client.Get(bsync); err == nil {
-					content, _ := io.ReadAll(response.Body)
-					response.Body.Close()
-					if response.StatusCode/100 == 2 {
-						sleases := map[string]LEASE{}
-						if json.Unmarshal(content, &sleases) == nil {
-							lock.Lock()
-							for address, lease := range sleases {
-								leases[address] = lease
+				if request, err := http.NewRequest(http.MethodGet, bsync, nil); err == nil {
+					if token := config.String("backend.sync_token"); token != "" {
+						request.Header.Set("Authorization", "Bearer "+token)
+					}
+					client := &http.Client{Timeout: 5 * time.Second}
+					if response, err := client.Do(request); err == nil {
+						content, _ := io.ReadAll(response.Body)
+						response.Body.Close()
+						if response.StatusCode/100 == 2 {
+							sleases := map[string]LEASE{}
+							if json.Unmarshal(content, &sleases) == nil {
+								lock.Lock()
+								for address, lease := range sleases {
+									apply(address, lease)
+								}
+								lock.Unlock()
 							}
-							lock.Unlock()
 						}
 					}
 				}
@@ -369,18 +934,11 @@ func main() {
 			lock.Lock()
 			now := time.Now().Unix()
 			for address, lease := range leases {
-				if lease.Deadline <= now {
+				if lease.expired(now) {
 					delete(leases, address)
 				}
 			}
 			lock.Unlock()
-			if path := config.String("backend.leases"); path != "" {
-				lock.RLock()
-				if content, err := json.Marshal(leases); err == nil {
-					os.WriteFile(path, content, 0o644)
-				}
-				lock.RUnlock()
-			}
 		}
 	}()
 
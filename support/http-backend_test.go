@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pyke369/golang-support/uconfig"
+	"github.com/pyke369/golang-support/ulog"
+)
+
+func testjournal(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "leases.json")
+	handle, err := os.OpenFile(path+".journal", os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log, leases, journal, fsync = ulog.New(""), map[string]LEASE{}, handle, "always"
+	t.Cleanup(func() {
+		journal.Close()
+		journal = nil
+	})
+
+	return path
+}
+
+func TestJournalReplay(t *testing.T) {
+	path, deadline := testjournal(t), time.Now().Unix()+3600
+	record("10.0.0.1", &LEASE{Client: "a", State: "bound", Deadline: deadline})
+	record("10.0.0.2", &LEASE{Client: "b", State: "bound", Deadline: deadline})
+	record("10.0.0.1", &LEASE{Client: "a", State: "bound", Deadline: deadline + 60})
+	record("10.0.0.2", nil)
+	record("10.0.0.3", &LEASE{Client: "c", State: "bound", Deadline: 1})
+	record("10.0.0.4", &LEASE{Client: "d", State: "reserved"})
+	// torn last entry (never acknowledged)
+	journal.WriteString(`0badc0de {"address":"10.0.0.5","lea`)
+
+	leases = map[string]LEASE{}
+	if err := load(path); err != nil {
+		t.Fatal(err)
+	}
+	if len(leases) != 2 || leases["10.0.0.1"].Deadline != deadline+60 || leases["10.0.0.4"].State != "reserved" {
+		t.Errorf("unexpected replayed leases %v", leases)
+	}
+}
+
+func TestJournalCorrupted(t *testing.T) {
+	path := testjournal(t)
+	record("10.0.0.1", &LEASE{Client: "a", State: "bound", Deadline: time.Now().Unix() + 3600})
+	payload := `{"address":"10.0.0.2","lease":{"client":"b"}}`
+	journal.WriteString(fmt.Sprintf("%08x %s\n", crc32.ChecksumIEEE([]byte(payload))+1, payload))
+
+	if err := load(path); err == nil {
+		t.Error("corrupted journal entry accepted")
+	}
+}
+
+func TestJournalCompaction(t *testing.T) {
+	path, deadline := testjournal(t), time.Now().Unix()+3600
+	record("10.0.0.1", &LEASE{Client: "a", State: "bound", Deadline: deadline})
+	leases["10.0.0.1"] = LEASE{Client: "a", State: "bound", Deadline: deadline}
+	if err := compact(path); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(path + ".journal"); err != nil || info.Size() != 0 {
+		t.Errorf("journal not truncated after compaction (%v)", err)
+	}
+
+	// changes recorded after the compaction are replayed on top of the snapshot
+	record("10.0.0.2", &LEASE{Client: "b", State: "bound", Deadline: deadline})
+	record("10.0.0.1", nil)
+	leases = map[string]LEASE{}
+	if err := load(path); err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := leases["10.0.0.1"]; exists || leases["10.0.0.2"].Client != "b" || len(leases) != 1 {
+		t.Errorf("unexpected leases after compaction and replay %v", leases)
+	}
+}
+
+func testapi(t *testing.T, content string) *httptest.Server {
+	var err error
+
+	if config, err = uconfig.New(content, map[string]any{"inline": true}); err != nil {
+		t.Fatal(err)
+	}
+	log, leases, journal, node, peers = ulog.New(""), map[string]LEASE{}, nil, "test", nil
+	server := httptest.NewServer(http.HandlerFunc(handler))
+	t.Cleanup(server.Close)
+
+	return server
+}
+
+func call(t *testing.T, method, url, token, body string) (int, string) {
+	request, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, _ := io.ReadAll(response.Body)
+	response.Body.Close()
+
+	return response.StatusCode, string(content)
+}
+
+func TestLeasesAPI(t *testing.T) {
+	server := testapi(t, `backend { api { tokens { ops = "secret" } } }`)
+	deadline := time.Now().Unix() + 3600
+	leases["10.0.0.1"] = LEASE{Client: "00:11:22:33:44:55", State: "lease", Deadline: deadline}
+	leases["10.0.1.1"] = LEASE{Client: "00:11:22:33:44:66", State: "lease", Deadline: deadline + 7200}
+
+	for _, test := range []struct {
+		method, path, token, body string
+		status                    int
+		contains, absent          string
+	}{
+		{"GET", "/leases", "", "", http.StatusUnauthorized, "", ""},
+		{"GET", "/leases", "invalid", "", http.StatusUnauthorized, "", ""},
+		{"GET", "/leases", "secret", "", http.StatusOK, `"10.0.1.1"`, ""},
+		{"GET", "/leases?pool=10.0.0.0/24", "secret", "", http.StatusOK, `{"10.0.0.1":`, "10.0.1.1"},
+		{"GET", "/leases?pool=10.0.1.0-10.0.1.9&state=lease", "secret", "", http.StatusOK, `{"10.0.1.1":`, "10.0.0.1"},
+		{"GET", "/leases?expiring-before=" + strconv.FormatInt(deadline+60, 10), "secret", "", http.StatusOK, `{"10.0.0.1":`, "10.0.1.1"},
+		{"GET", "/leases?expiring-before=invalid", "secret", "", http.StatusBadRequest, "", ""},
+		{"GET", "/leases/00:11:22:33:44:66", "secret", "", http.StatusOK, `"address":"10.0.1.1"`, ""},
+		{"GET", "/leases/10.0.0.9", "secret", "", http.StatusNotFound, "", ""},
+		{"PUT", "/leases/10.0.0.1", "secret", `{"state":"reserved","client":"00:11:22:33:44:77"}`, http.StatusConflict, `"client":"00:11:22:33:44:55"`, ""},
+		{"PUT", "/leases/10.0.0.1?force=1", "secret", `{"state":"reserved","client":"00:11:22:33:44:77"}`, http.StatusOK, `"state":"reserved"`, ""},
+		{"PUT", "/leases/10.0.0.2", "secret", `{"state":"hold","client":"00:11:22:33:44:77"}`, http.StatusBadRequest, "", ""},
+		{"PUT", "/leases/10.0.0.2", "secret", `{"state":"lease"}`, http.StatusBadRequest, "", ""},
+		{"PUT", "/leases/invalid", "secret", `{"state":"hold"}`, http.StatusBadRequest, "", ""},
+		{"PUT", "/leases/10.0.0.2", "secret", `{"state":"hold"}`, http.StatusOK, `"state":"hold"`, ""},
+		{"POST", "/leases/10.0.1.1/expire", "secret", "", http.StatusOK, `"address":"10.0.1.1"`, ""},
+		{"DELETE", "/leases/00:11:22:33:44:66", "secret", "", http.StatusNoContent, "", ""},
+		{"GET", "/leases/10.0.1.1", "secret", "", http.StatusNotFound, "", ""},
+		{"GET", "/leases?state=deleted", "secret", "", http.StatusOK, `"10.0.1.1"`, "10.0.0.1"},
+		{"PATCH", "/leases/10.0.0.1", "secret", "", http.StatusMethodNotAllowed, "", ""},
+	} {
+		status, content := call(t, test.method, server.URL+test.path, test.token, test.body)
+		if status != test.status || !strings.Contains(content, test.contains) || (test.absent != "" && strings.Contains(content, test.absent)) {
+			t.Errorf("%s %s = %d %s", test.method, test.path, status, content)
+		}
+	}
+
+	// deleted leases are versioned tombstones, and reservations never expire
+	if lease := leases["10.0.1.1"]; lease.State != "deleted" || lease.Version == 0 || lease.expired(time.Now().Unix()) {
+		t.Errorf("deleted lease %+v", lease)
+	}
+	if lease := leases["10.0.0.1"]; lease.Client != "00:11:22:33:44:77" || lease.expired(time.Now().Unix()+86400) {
+		t.Errorf("reserved lease %+v", lease)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	server := testapi(t, `backend { peer_token = "shared", api { tokens { ops = "secret" } } }`)
+	deadline := time.Now().Unix() + 3600
+	leases["10.0.0.1"] = LEASE{Client: "a", State: "lease", Deadline: deadline, Version: 10, Node: "test"}
+
+	for _, test := range []struct {
+		method, path, token, body string
+		status                    int
+	}{
+		{"POST", "/leases", "secret", `[]`, http.StatusForbidden},
+		{"POST", "/leases", "shared", `invalid`, http.StatusBadRequest},
+		{"POST", "/leases", "shared", `[{"address":"10.0.0.1","lease":{"client":"b","state":"lease","version":5,"node":"other"}},
+			{"address":"10.0.0.2","lease":{"client":"c","state":"lease","version":5,"node":"other"}}]`, http.StatusNoContent},
+		{"GET", "/leases?all=1", "shared", "", http.StatusOK},
+		{"GET", "/leases/10.0.0.1", "shared", "", http.StatusForbidden},
+		{"PUT", "/leases/10.0.0.3", "shared", `{"state":"hold"}`, http.StatusForbidden},
+		{"DELETE", "/leases/10.0.0.1", "shared", "", http.StatusForbidden},
+	} {
+		if status, content := call(t, test.method, server.URL+test.path, test.token, test.body); status != test.status {
+			t.Errorf("%s %s (%s) = %d %s", test.method, test.path, test.token, status, content)
+		}
+	}
+
+	// only the most recent versions are applied
+	if leases["10.0.0.1"].Client != "a" || leases["10.0.0.2"].Client != "c" {
+		t.Errorf("replicated leases %v", leases)
+	}
+}
+
+func TestReplicationPush(t *testing.T) {
+	server := testapi(t, `backend { peer_token = "shared" }`)
+	peer := &PEER{url: server.URL + "/leases", pending: map[string]JENTRY{}, signal: make(chan struct{}, 1)}
+	peers = []*PEER{peer}
+
+	// local changes are versioned and queued for every peer, the last change to an address superseding previous ones
+	store("10.0.0.1", LEASE{Client: "a", State: "lease", Deadline: time.Now().Unix() + 3600})
+	store("10.0.0.1", LEASE{Client: "a", State: "lease", Deadline: time.Now().Unix() + 7200})
+	remove("10.0.0.2")
+	store("10.0.0.2", LEASE{Client: "b", State: "prelease"})
+	remove("10.0.0.2")
+	if len(peer.pending) != 2 || peer.pending["10.0.0.1"].Lease.Version != leases["10.0.0.1"].Version ||
+		peer.pending["10.0.0.2"].Lease.State != "deleted" || peer.pending["10.0.0.1"].Lease.Node != "test" {
+		t.Fatalf("pending entries %v", peer.pending)
+	}
+
+	entries := []JENTRY{peer.pending["10.0.0.1"], peer.pending["10.0.0.2"]}
+	leases = map[string]LEASE{}
+	if reason := send(peer.url, entries); reason != "" {
+		t.Fatal(reason)
+	}
+	if leases["10.0.0.1"].Client != "a" || leases["10.0.0.2"].State != "deleted" {
+		t.Errorf("pushed leases %v", leases)
+	}
+
+	// replicated changes are never queued back
+	if len(peer.pending) != 2 {
+		t.Errorf("pending entries %v", peer.pending)
+	}
+
+	if reason := send(server.URL+"/", entries); reason != "HTTP status 422" {
+		t.Errorf("push to a wrong URL: %q", reason)
+	}
+}
+
+func TestSecure(t *testing.T) {
+	for _, test := range []struct {
+		remote string
+		tls    bool
+		secure bool
+	}{
+		{"127.0.0.1:1234", false, true},
+		{"[::1]:1234", false, true},
+		{"192.0.2.1:1234", false, false},
+		{"192.0.2.1:1234", true, true},
+	} {
+		request := httptest.NewRequest(http.MethodGet, "/leases", nil)
+		request.RemoteAddr = test.remote
+		if test.tls {
+			request.TLS = &tls.ConnectionState{}
+		}
+		if secure(request) != test.secure {
+			t.Errorf("secure(%s, %t) = %t", test.remote, test.tls, !test.secure)
+		}
+	}
+}
@@ -4,8 +4,11 @@ import sys, json
 
 while True:
     try:
-        request = json.loads(sys.stdin.readline())
+        request, envelope = json.loads(sys.stdin.readline()), None
         sys.stderr.write('recv ' + json.dumps(request) + "\n")
+        if 'frame' in request:
+            # enveloped request (pdhcp -E)
+            envelope, request = request, request['frame']
         msgtype = request.get('dhcp-message-type', '')
         if msgtype == 'discover' or msgtype == 'request':
             # filename = 'ipxe.efi' if request.get('client-system', 0) == 7 else 'undionly.kpxe'
@@ -25,9 +28,15 @@ while True:
                 # 'bootp-server-address':    '192.168.23.254',
                 # 'bootp-filename':          filename
             }
+            if envelope:
+                response = { 'id': envelope['id'], 'frame': response }
             sys.stderr.write('send ' + json.dumps(response) + "\n")
             sys.stdout.write(json.dumps(response) + '\n')
             sys.stdout.flush()
 
+        elif envelope:
+            sys.stdout.write(json.dumps({ 'id': envelope['id'] }) + '\n')
+            sys.stdout.flush()
+
     except:
         break
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pyke369/golang-support/chash"
+)
+
+type WORKER struct {
+	name   string
+	pid    int
+	input  io.Writer
+	output io.Reader
+	kill   func()
+	wait   func() error
+}
+
+func spawn(command string) (worker *WORKER, err error) {
+	parts := strings.Split(command, " ")
+	path, err := exec.LookPath(parts[0])
+	if err != nil {
+		return nil, err
+	}
+	parts[0] = filepath.Base(parts[0])
+	cmd := &exec.Cmd{Path: path, Args: parts, Stderr: os.Stderr}
+	worker = &WORKER{name: cmd.Path, kill: func() { cmd.Process.Kill() }, wait: cmd.Wait}
+	if worker.input, err = cmd.StdinPipe(); err != nil {
+		return nil, err
+	}
+	if worker.output, err = cmd.StdoutPipe(); err != nil {
+		return nil, err
+	}
+	if err = cmd.Start(); err != nil {
+		return nil, err
+	}
+	worker.pid = cmd.Process.Pid
+
+	return
+}
+
+func connect(backend string) (worker *WORKER, err error) {
+	remote, err := url.Parse(backend)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.Dial("unix", remote.Path)
+	if err != nil {
+		return nil, err
+	}
+	pid, uid, gid, err := PeerCredentials(conn.(*net.UnixConn))
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	for name, value := range map[string]int{"uid": uid, "gid": gid} {
+		if expected := remote.Query().Get(name); expected != "" && expected != strconv.Itoa(value) {
+			conn.Close()
+			return nil, errors.New("peer " + name + " mismatch (" + strconv.Itoa(value) + " instead of " + expected + ")")
+		}
+	}
+
+	return &WORKER{
+		name:   remote.Path,
+		pid:    pid,
+		input:  conn,
+		output: conn,
+		kill:   func() { conn.Close() },
+		wait:   func() error { conn.Close(); return nil },
+	}, nil
+}
+
+// the worker handling a client is elected on the consistent hash ring (-1 if no worker is currently available)
+func affine(ring *chash.CHash, frame FRAME) int {
+	if targets := ring.Lookup(v4client(frame), 1); len(targets) > 0 {
+		if index, err := strconv.Atoi(targets[0]); err == nil {
+			return index
+		}
+	}
+
+	return -1
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+
+	"github.com/pyke369/golang-support/chash"
+)
+
+func TestAffine(t *testing.T) {
+	ring := chash.New()
+	if index := affine(ring, FRAME{"client-hardware-address": "00:11:22:33:44:55"}); index != -1 {
+		t.Errorf("worker %d elected on an empty ring", index)
+	}
+	for index := range 4 {
+		ring.AddTarget(strconv.Itoa(index), 1)
+	}
+
+	clients, used := map[string]int{}, map[int]bool{}
+	for index := range 64 {
+		client := fmt.Sprintf("00:11:22:33:44:%02x", index)
+		clients[client] = affine(ring, FRAME{"client-hardware-address": client})
+		used[clients[client]] = true
+		if again := affine(ring, FRAME{"client-hardware-address": client}); again != clients[client] {
+			t.Errorf("client %s moved from worker %d to %d", client, clients[client], again)
+		}
+	}
+	if len(used) != 4 {
+		t.Errorf("only %d workers elected", len(used))
+	}
+
+	// the client identifier takes precedence over the hardware address
+	if affine(ring, FRAME{"client-hardware-address": "00:11:22:33:44:00", "client-identifier": "01001122334401"}) !=
+		affine(ring, FRAME{"client-identifier": "01001122334401"}) {
+		t.Errorf("client identifier not used for affinity")
+	}
+
+	// only the clients of a removed worker are redistributed, and get back to it once restarted
+	ring.RemoveTarget("2")
+	for client, index := range clients {
+		actual := affine(ring, FRAME{"client-hardware-address": client})
+		if (index == 2 && actual == 2) || (index != 2 && actual != index) {
+			t.Errorf("client %s moved from worker %d to %d", client, index, actual)
+		}
+	}
+	ring.AddTarget("2", 1)
+	for client, index := range clients {
+		if actual := affine(ring, FRAME{"client-hardware-address": client}); actual != index {
+			t.Errorf("client %s moved from worker %d to %d after restart", client, index, actual)
+		}
+	}
+}